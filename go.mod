@@ -10,7 +10,12 @@ require (
 	github.com/olivere/elastic v6.2.36+incompatible
 	github.com/opentracing/opentracing-go v1.2.0
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.11.0
+	github.com/shirou/gopsutil/v3 v3.22.3
 	github.com/spf13/viper v1.8.1
 	github.com/stretchr/testify v1.7.1
+	github.com/uber/jaeger-client-go v2.29.1+incompatible
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
+	google.golang.org/grpc v1.39.0
 	gopkg.in/yaml.v2 v2.4.0
 )
@@ -2,16 +2,22 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/jaegertracing/jaeger/plugin/storage/grpc/shared"
 	"github.com/logzio/jaeger-logzio/store"
+	"io"
 	"os"
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/jaegertracing/jaeger/plugin/storage/grpc"
+	"github.com/opentracing/opentracing-go"
 )
 
 const (
 	loggerName = "jaeger-logzio"
+	// exit codes of a misconfigured plugin
+	exitCodeConfigError = 1
+	exitCodeStoreError  = 2
 )
 
 func main() {
@@ -27,13 +33,38 @@ func main() {
 
 	logzioConfig, err := store.ParseConfig(configPath, logger)
 	if err != nil {
-		logger.Error("can't parse config: ", err.Error())
-		os.Exit(0)
+		logger.Error(fmt.Sprintf("can't parse config: %s", err.Error()))
+		os.Exit(exitCodeConfigError)
 	}
 	logger.Info(logzioConfig.String())
-	logzioStore := store.NewLogzioStore(*logzioConfig, logger)
+	if logzioConfig.MetricsAddress != "" {
+		go store.ServeMetrics(logzioConfig.MetricsAddress, logger)
+	}
+	logzioStore, err := store.NewLogzioStore(*logzioConfig, logger)
+	if err != nil {
+		logger.Error(fmt.Sprintf("can't create logz.io storage: %s", err.Error()))
+		os.Exit(exitCodeStoreError)
+	}
+	logger.Info(logzioStore.Summary())
+	if logzioConfig.HealthAddress != "" {
+		go store.ServeHealth(logzioConfig.HealthAddress, *logzioConfig, logzioStore, logger)
+	}
+	var tracerCloser io.Closer
+	if logzioConfig.SelfTracing {
+		tracer, closer, err := store.NewSelfTracer(*logzioConfig, logzioStore.LogzioSpanWriter(), logger)
+		if err != nil {
+			logger.Error(fmt.Sprintf("can't create self tracer: %s", err.Error()))
+		} else {
+			opentracing.SetGlobalTracer(tracer)
+			tracerCloser = closer
+		}
+	}
 	grpc.Serve(&shared.PluginServices{
-		Store: logzioStore,
+		Store:        logzioStore,
+		ArchiveStore: logzioStore,
 	})
+	if tracerCloser != nil {
+		_ = tracerCloser.Close()
+	}
 	logzioStore.Close()
 }
\ No newline at end of file
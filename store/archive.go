@@ -0,0 +1,60 @@
+package store
+
+import (
+	"context"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/logzio/jaeger-logzio/store/objects"
+)
+
+const (
+	archiveSpanDocumentType = "jaegerArchiveSpan"
+)
+
+// NewLogzioArchiveSpanReader creates a new logzio span reader for archived traces.
+// Archived traces are searched without the regular search window limit
+func NewLogzioArchiveSpanReader(config LogzioConfig, logger hclog.Logger) *LogzioSpanReader {
+	return newLogzioSpanReader(config, config.archiveAPIToken(), archiveSpanDocumentType, true, logger)
+}
+
+// LogzioArchiveSpanWriter is a struct which holds logzio archive span writer properties
+type LogzioArchiveSpanWriter struct {
+	logger     hclog.Logger
+	sender     *logzioSender
+	spanLimits SpanLimits
+	tagLayout  objects.TagLayout
+}
+
+// NewLogzioArchiveSpanWriter creates a new logzio span writer for archived traces
+func NewLogzioArchiveSpanWriter(config LogzioConfig, logger hclog.Logger) (*LogzioArchiveSpanWriter, error) {
+	sender, err := newLogzioSender(config, config.archiveAccountToken(), "", logger)
+	if err != nil {
+		return nil, err
+	}
+	return &LogzioArchiveSpanWriter{
+		logger:     logger,
+		sender:     sender,
+		spanLimits: config.SpanLimits,
+		tagLayout:  config.tagLayout(),
+	}, nil
+}
+
+// WriteSpan receives a Jaeger span of an archived trace, converts it to logzio archive span and sends it to logzio
+func (archiveWriter *LogzioArchiveSpanWriter) WriteSpan(ctx context.Context, span *model.Span) error {
+	spanBytes, err := archiveWriter.spanLimits.transformSpan(span, archiveWriter.tagLayout.TransformToLogzioArchiveSpanBytes)
+	if err == nil {
+		err = archiveWriter.sender.Send(spanBytes)
+	}
+	if err != nil {
+		writeErrorsTotal.Inc()
+		return err
+	}
+	spansWrittenTotal.WithLabelValues(archiveSpanDocumentType).Inc()
+	return nil
+}
+
+// Close stops and drains logzio sender
+func (archiveWriter *LogzioArchiveSpanWriter) Close() {
+	archiveWriter.sender.Stop()
+}
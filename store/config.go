@@ -1,6 +1,7 @@
 package store
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/hashicorp/go-hclog"
 	"github.com/spf13/viper"
@@ -10,27 +11,98 @@ import (
 	"strings"
 	"time"
 
+	"github.com/logzio/jaeger-logzio/store/objects"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 )
 
 const (
-	accountTokenParam     = "ACCOUNT_TOKEN"
-	apiTokenParam         = "API_TOKEN"
-	regionParam           = "REGION"
-	customListenerParam   = "CUSTOM_LISTENER_URL"
-	customAPIParam        = "CUSTOM_API"
-	usRegionCode          = "us"
-	customQueueDirParam   = "CUSTOM_QUEUE_DIR"
-	inMemoryQueueParam    = "IN_MEMORY_QUEUE"
-	CompressParam         = "COMPRESS"
-	InMemoryCapacityParam = "IN_MEMORY_CAPACITY"
-	LogCountLimitParam    = "LOG_COUNT_LIMIT"
-	DrainIntervalParam    = "DRAIN_INTERVAL"
+	accountTokenParam         = "ACCOUNT_TOKEN"
+	apiTokenParam             = "API_TOKEN"
+	archiveAccountTokenParam  = "ARCHIVE_ACCOUNT_TOKEN"
+	archiveAPITokenParam      = "ARCHIVE_API_TOKEN"
+	regionParam               = "REGION"
+	customListenerParam       = "CUSTOM_LISTENER_URL"
+	customAPIParam            = "CUSTOM_API"
+	usRegionCode              = "us"
+	customQueueDirParam       = "CUSTOM_QUEUE_DIR"
+	inMemoryQueueParam        = "IN_MEMORY_QUEUE"
+	CompressParam             = "COMPRESS"
+	InMemoryCapacityParam     = "IN_MEMORY_CAPACITY"
+	LogCountLimitParam        = "LOG_COUNT_LIMIT"
+	DrainIntervalParam        = "DRAIN_INTERVAL"
+	writeDependenciesParam    = "WRITE_DEPENDENCIES"
+	dependenciesIntervalParam = "DEPENDENCIES_INTERVAL"
+	maxSearchWindowHoursParam = "MAX_SEARCH_WINDOW_HOURS"
+	retentionDaysParam        = "RETENTION_DAYS"
+	archiveRetentionDaysParam = "ARCHIVE_RETENTION_DAYS"
+	fetchConcurrencyParam     = "FETCH_CONCURRENCY"
+	queryTimeoutParam         = "QUERY_TIMEOUT"
+	apiRequestsPerSecondParam = "API_REQUESTS_PER_SECOND"
+	metricsAddressParam       = "METRICS_ADDRESS"
+	healthAddressParam        = "HEALTH_ADDRESS"
+	redactionRulesParam       = "REDACTION_RULES"
+	filterRulesParam          = "FILTER_RULES"
+	extraFieldsParam          = "EXTRA_FIELDS"
+	searchFieldsParam         = "SEARCH_FIELDS"
+	tenantsParam              = "TENANTS"
+	tenantHeaderParam         = "TENANT_HEADER"
+	tagLayoutParam            = "TAG_LAYOUT"
+	tagKeysAsFieldsParam      = "TAG_KEYS_AS_FIELDS"
+	logFieldsNestedParam      = "LOG_FIELDS_NESTED"
+	tagSearchWindowHoursParam = "TAG_SEARCH_WINDOW_HOURS"
+	tagSearchNumTracesParam   = "TAG_SEARCH_NUM_TRACES"
+	traceLevelSearchParam     = "TRACE_LEVEL_SEARCH"
+	traceDurationParam        = "TRACE_DURATION"
+	selfTracingParam          = "SELF_TRACING"
+	selfTracingRateParam      = "SELF_TRACING_RATE"
+	// tag layouts, all the tags as typed fields, only TagKeysAsFields as typed fields, or all the tags in lists
+	tagLayoutAllAsFields  = "allAsFields"
+	tagLayoutKeysAsFields = "keysAsFields"
+	tagLayoutNested       = "nested"
+	// spans the duration of trace searches is matched by, any span, the root span or the whole trace
+	traceDurationSpan  = "span"
+	traceDurationRoot  = "root"
+	traceDurationTrace = "trace"
+	// tail sampling parameters, nested under tailSampling in the yaml config
+	tailSamplingParam                = "TAIL_SAMPLING"
+	tailSamplingDecisionWaitParam    = "TAIL_SAMPLING_DECISION_WAIT"
+	tailSamplingMaxTracesParam       = "TAIL_SAMPLING_MAX_TRACES"
+	tailSamplingMaxBytesParam        = "TAIL_SAMPLING_MAX_BYTES"
+	tailSamplingKeepErrorsParam      = "TAIL_SAMPLING_KEEP_ERRORS"
+	tailSamplingMinRootDurationParam = "TAIL_SAMPLING_MIN_ROOT_DURATION"
+	tailSamplingServicesParam        = "TAIL_SAMPLING_SERVICES"
+	tailSamplingBaselineRateParam    = "TAIL_SAMPLING_BASELINE_RATE"
+	// span size limits parameters, nested under spanLimits in the yaml config
+	spanMaxTagValueLengthParam = "SPAN_MAX_TAG_VALUE_LENGTH"
+	spanMaxLogsParam           = "SPAN_MAX_LOGS"
+	spanMaxLogFieldsParam      = "SPAN_MAX_LOG_FIELDS"
+	spanMaxDocumentBytesParam  = "SPAN_MAX_DOCUMENT_BYTES"
 	// default values for in memory queue config
 	defaultInMemoryCapacity = uint64(20 * 1024 * 1024)
 	defaultLogCountLimit    = 500000
 	defaultDrainInterval    = 3
+	// default interval in seconds for precomputed dependencies
+	defaultDependenciesInterval = 60
+	// default limit in hours for how far back traces can be searched
+	defaultMaxSearchWindowHours = 48
+	// default search window in hours and number of traces of searches without a service
+	defaultTagSearchWindowHours = 6
+	defaultTagSearchNumTraces   = 20
+	// default trace fetching concurrency and timeout in seconds
+	defaultFetchConcurrency = 4
+	defaultQueryTimeout     = 60
+	// default client side rate limit of the logz.io search api
+	defaultAPIRequestsPerSecond = 10
+	// by default all the operations of the plugin are traced when self tracing is enabled
+	defaultSelfTracingRate = 1.0
+	// default tail sampling decision wait in seconds, buffered traces and bytes limits and baseline traces per second
+	defaultTailSamplingDecisionWait = 10
+	defaultTailSamplingMaxTraces    = 50000
+	defaultTailSamplingMaxBytes     = 268435456
+	defaultTailSamplingBaselineRate = 1.0
+	// default size limit of span documents, the logz.io listener rejects larger documents
+	defaultSpanMaxDocumentBytes = 500000
 )
 
 // LogzioConfig struct for logzio span store
@@ -46,17 +118,73 @@ type LogzioConfig struct {
 	InMemoryCapacity  uint64 `yaml:"inMemoryCapacity"`
 	LogCountLimit     int    `yaml:"logCountLimit"`
 	DrainInterval     int    `yaml:"drainInterval"`
+	// WriteDependencies enables sending precomputed service dependencies with the spans
+	WriteDependencies    bool `yaml:"writeDependencies"`
+	DependenciesInterval int  `yaml:"dependenciesInterval"`
+	// ArchiveAccountToken and ArchiveAPIToken are optional, archived traces are stored in the main account by default
+	ArchiveAccountToken string `yaml:"archiveAccountToken"`
+	ArchiveAPIToken     string `yaml:"archiveApiToken"`
+	// MaxSearchWindowHours limits how far back traces are searched, longer windows are split to several searches
+	MaxSearchWindowHours int `yaml:"maxSearchWindowHours"`
+	// RetentionDays limits how far back a single trace is looked up by its trace id
+	RetentionDays int `yaml:"retentionDays"`
+	// ArchiveRetentionDays limits how far back an archived trace is looked up, it defaults to the trace lookup window
+	ArchiveRetentionDays int `yaml:"archiveRetentionDays"`
+	// FetchConcurrency limits the number of parallel trace searches of a single query
+	FetchConcurrency int `yaml:"fetchConcurrency"`
+	// QueryTimeout in seconds limits the total time of fetching the traces of a single query
+	QueryTimeout int `yaml:"queryTimeout"`
+	// APIRequestsPerSecond limits the rate of the requests to the logz.io search api by all the queries of the process
+	APIRequestsPerSecond float64 `yaml:"apiRequestsPerSecond"`
+	// MetricsAddress is the address of the prometheus /metrics listener, metrics are not exposed if it's empty
+	MetricsAddress string `yaml:"metricsAddress"`
+	// HealthAddress is the address of the /health and /ready listener, health checks are not exposed if it's empty
+	HealthAddress string `yaml:"healthAddress"`
+	// SelfTracing enables tracing the operations of the plugin, the spans are written to the account of AccountToken.
+	// SelfTracingRate is the fraction of the traced operations
+	SelfTracing     bool    `yaml:"selfTracing"`
+	SelfTracingRate float64 `yaml:"selfTracingRate"`
+	// RedactionRules are applied to the tags and log fields of every span before it's written
+	RedactionRules []RedactionRule `yaml:"redactionRules"`
+	// FilterRules decide which spans are written
+	FilterRules []FilterRule `yaml:"filterRules"`
+	// TailSampling buffers the spans of every trace and writes only the traces its policies keep
+	TailSampling TailSamplingConfig `yaml:"tailSampling"`
+	// SpanLimits truncates the spans which are too large to be shipped
+	SpanLimits SpanLimits `yaml:"spanLimits"`
+	// ExtraFields are added to the top level of every span, service and dependency document the writer sends,
+	// values such as ${K8S_CLUSTER} are read from environment variables
+	ExtraFields map[string]string `yaml:"extraFields"`
+	// SearchFields scope all the searches of the reader to the documents with these fields, like ExtraFields
+	SearchFields map[string]string `yaml:"searchFields"`
+	// Tenants route spans and queries to the accounts of several teams, AccountToken and APIToken are the default account.
+	// TenantHeader is the grpc metadata key which names the tenant of a request, x-tenant by default
+	Tenants      []Tenant `yaml:"tenants"`
+	TenantHeader string   `yaml:"tenantHeader"`
+	// TagLayout is allAsFields, keysAsFields or nested. Tags stored as fields keep their type and can be range queried
+	TagLayout       string   `yaml:"tagLayout"`
+	TagKeysAsFields []string `yaml:"tagKeysAsFields"`
+	// LogFieldsNested searches the fields of the span logs with nested queries, for accounts which map them as nested
+	LogFieldsNested bool `yaml:"logFieldsNested"`
+	// TagSearchWindowHours limits the searches by tags without a service, which match the spans of all the services,
+	// and TagSearchNumTraces is their number of traces when the search doesn't set it
+	TagSearchWindowHours int `yaml:"tagSearchWindowHours"`
+	TagSearchNumTraces   int `yaml:"tagSearchNumTraces"`
+	// TraceLevelSearch matches the service, operation and every tag of trace searches by any span of the trace,
+	// not only by a single span. TraceDuration is span, root or trace, the duration the search duration range applies to
+	TraceLevelSearch bool   `yaml:"traceLevelSearch"`
+	TraceDuration    string `yaml:"traceDuration"`
 }
 
 // validate logzio config, return error if invalid
 func (config *LogzioConfig) validate(logger hclog.Logger) error {
-	if config.AccountToken == "" && config.APIToken == "" {
+	if config.AccountToken == "" && config.APIToken == "" && len(config.Tenants) == 0 {
 		return errors.New("At least one of logz.io account token or api-token has to be valid")
 	}
-	if config.APIToken == "" {
+	if config.APIToken == "" && len(config.Tenants) == 0 {
 		logger.Warn("No api token found, can't create span reader")
 	}
-	if config.AccountToken == "" {
+	if config.AccountToken == "" && len(config.Tenants) == 0 {
 		logger.Warn("No account token found, spans will not be saved")
 	}
 	if config.CustomQueueDir != "" {
@@ -65,6 +193,38 @@ func (config *LogzioConfig) validate(logger hclog.Logger) error {
 			return errors.New(errMessage)
 		}
 	}
+	if _, err := newRedactor(config.RedactionRules); err != nil {
+		return err
+	}
+	if _, err := newSpanFilter(config.FilterRules); err != nil {
+		return err
+	}
+	if _, err := config.TailSampling.minRootDuration(); err != nil {
+		return err
+	}
+	if _, err := newExtraFields(config.ExtraFields); err != nil {
+		return err
+	}
+	if _, err := newExtraFields(config.SearchFields); err != nil {
+		return errors.Wrap(err, "invalid search fields")
+	}
+	if _, err := newTenantRouter(config.TenantHeader, config.Tenants); err != nil {
+		return err
+	}
+	switch config.TraceDuration {
+	case "", traceDurationSpan, traceDurationRoot, traceDurationTrace:
+	default:
+		return fmt.Errorf("unknown trace duration %q, expected one of span, root or trace", config.TraceDuration)
+	}
+	switch config.TagLayout {
+	case "", tagLayoutAllAsFields, tagLayoutNested:
+	case tagLayoutKeysAsFields:
+		if len(config.TagKeysAsFields) == 0 {
+			return errors.New("the keysAsFields tag layout requires tag keys as fields")
+		}
+	default:
+		return fmt.Errorf("unknown tag layout %q, expected one of allAsFields, keysAsFields or nested", config.TagLayout)
+	}
 	config.Region = strings.ToLower(config.Region)
 	validRegionCodes := [8]string{"", "us", "eu", "nl", "ca", "wa", "uk", "au"}
 	regionIsValid := false
@@ -93,6 +253,25 @@ func ParseConfig(filePath string, logger hclog.Logger) (*LogzioConfig, error) {
 		logzioConfig.InMemoryCapacity = defaultInMemoryCapacity
 		logzioConfig.InMemoryQueue = false
 		logzioConfig.DrainInterval = defaultDrainInterval
+		logzioConfig.DependenciesInterval = defaultDependenciesInterval
+		logzioConfig.MaxSearchWindowHours = defaultMaxSearchWindowHours
+		logzioConfig.TagSearchWindowHours = defaultTagSearchWindowHours
+		logzioConfig.TagSearchNumTraces = defaultTagSearchNumTraces
+		logzioConfig.FetchConcurrency = defaultFetchConcurrency
+		logzioConfig.QueryTimeout = defaultQueryTimeout
+		logzioConfig.APIRequestsPerSecond = defaultAPIRequestsPerSecond
+		logzioConfig.SelfTracingRate = defaultSelfTracingRate
+		logzioConfig.TailSampling = TailSamplingConfig{
+			DecisionWait:            defaultTailSamplingDecisionWait,
+			MaxTraces:               defaultTailSamplingMaxTraces,
+			MaxBytes:                defaultTailSamplingMaxBytes,
+			KeepErrors:              true,
+			BaselineTracesPerSecond: defaultTailSamplingBaselineRate,
+		}
+		logzioConfig.SpanLimits.MaxDocumentBytes = defaultSpanMaxDocumentBytes
+		logzioConfig.TenantHeader = defaultTenantHeader
+		logzioConfig.TagLayout = tagLayoutAllAsFields
+		logzioConfig.TraceDuration = traceDurationSpan
 		yamlFile, err := ioutil.ReadFile(filePath)
 		if err != nil {
 			return nil, err
@@ -110,6 +289,8 @@ func ParseConfig(filePath string, logger hclog.Logger) (*LogzioConfig, error) {
 		v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 		v.SetDefault(regionParam, "")
 		v.SetDefault(customAPIParam, "")
+		v.SetDefault(archiveAccountTokenParam, "")
+		v.SetDefault(archiveAPITokenParam, "")
 		v.SetDefault(customListenerParam, "")
 		v.SetDefault(customQueueDirParam, "")
 		v.SetDefault(inMemoryQueueParam, false)
@@ -117,19 +298,127 @@ func ParseConfig(filePath string, logger hclog.Logger) (*LogzioConfig, error) {
 		v.SetDefault(InMemoryCapacityParam, defaultInMemoryCapacity)
 		v.SetDefault(LogCountLimitParam, defaultLogCountLimit)
 		v.SetDefault(DrainIntervalParam, defaultDrainInterval)
+		v.SetDefault(writeDependenciesParam, false)
+		v.SetDefault(dependenciesIntervalParam, defaultDependenciesInterval)
+		v.SetDefault(maxSearchWindowHoursParam, defaultMaxSearchWindowHours)
+		v.SetDefault(retentionDaysParam, 0)
+		v.SetDefault(archiveRetentionDaysParam, 0)
+		v.SetDefault(fetchConcurrencyParam, defaultFetchConcurrency)
+		v.SetDefault(queryTimeoutParam, defaultQueryTimeout)
+		v.SetDefault(apiRequestsPerSecondParam, defaultAPIRequestsPerSecond)
+		v.SetDefault(metricsAddressParam, "")
+		v.SetDefault(healthAddressParam, "")
+		v.SetDefault(redactionRulesParam, "")
+		v.SetDefault(filterRulesParam, "")
+		v.SetDefault(extraFieldsParam, "")
+		v.SetDefault(searchFieldsParam, "")
+		v.SetDefault(tenantsParam, "")
+		v.SetDefault(tenantHeaderParam, defaultTenantHeader)
+		v.SetDefault(tagLayoutParam, tagLayoutAllAsFields)
+		v.SetDefault(tagKeysAsFieldsParam, "")
+		v.SetDefault(logFieldsNestedParam, false)
+		v.SetDefault(tagSearchWindowHoursParam, defaultTagSearchWindowHours)
+		v.SetDefault(tagSearchNumTracesParam, defaultTagSearchNumTraces)
+		v.SetDefault(traceLevelSearchParam, false)
+		v.SetDefault(traceDurationParam, traceDurationSpan)
+		v.SetDefault(selfTracingParam, false)
+		v.SetDefault(selfTracingRateParam, defaultSelfTracingRate)
+		v.SetDefault(tailSamplingParam, false)
+		v.SetDefault(tailSamplingDecisionWaitParam, defaultTailSamplingDecisionWait)
+		v.SetDefault(tailSamplingMaxTracesParam, defaultTailSamplingMaxTraces)
+		v.SetDefault(tailSamplingMaxBytesParam, defaultTailSamplingMaxBytes)
+		v.SetDefault(tailSamplingKeepErrorsParam, true)
+		v.SetDefault(tailSamplingMinRootDurationParam, "")
+		v.SetDefault(tailSamplingServicesParam, "")
+		v.SetDefault(tailSamplingBaselineRateParam, defaultTailSamplingBaselineRate)
+		v.SetDefault(spanMaxTagValueLengthParam, 0)
+		v.SetDefault(spanMaxLogsParam, 0)
+		v.SetDefault(spanMaxLogFieldsParam, 0)
+		v.SetDefault(spanMaxDocumentBytesParam, defaultSpanMaxDocumentBytes)
 		v.AutomaticEnv()
 		logzioConfig = &LogzioConfig{
-			Region:            v.GetString(regionParam),
-			AccountToken:      v.GetString(accountTokenParam),
-			APIToken:          v.GetString(apiTokenParam),
-			CustomAPIURL:      v.GetString(customAPIParam),
-			CustomListenerURL: v.GetString(customListenerParam),
-			CustomQueueDir:    v.GetString(customQueueDirParam),
-			InMemoryQueue:     v.GetBool(inMemoryQueueParam),
-			Compress:          v.GetBool(CompressParam),
-			InMemoryCapacity:  v.GetUint64(InMemoryCapacityParam),
-			LogCountLimit:     v.GetInt(LogCountLimitParam),
-			DrainInterval:     v.GetInt(DrainIntervalParam),
+			Region:               v.GetString(regionParam),
+			AccountToken:         v.GetString(accountTokenParam),
+			APIToken:             v.GetString(apiTokenParam),
+			ArchiveAccountToken:  v.GetString(archiveAccountTokenParam),
+			ArchiveAPIToken:      v.GetString(archiveAPITokenParam),
+			MaxSearchWindowHours: v.GetInt(maxSearchWindowHoursParam),
+			RetentionDays:        v.GetInt(retentionDaysParam),
+			FetchConcurrency:     v.GetInt(fetchConcurrencyParam),
+			QueryTimeout:         v.GetInt(queryTimeoutParam),
+			APIRequestsPerSecond: v.GetFloat64(apiRequestsPerSecondParam),
+			MetricsAddress:       v.GetString(metricsAddressParam),
+			HealthAddress:        v.GetString(healthAddressParam),
+			SelfTracing:          v.GetBool(selfTracingParam),
+			SelfTracingRate:      v.GetFloat64(selfTracingRateParam),
+			CustomAPIURL:         v.GetString(customAPIParam),
+			CustomListenerURL:    v.GetString(customListenerParam),
+			CustomQueueDir:       v.GetString(customQueueDirParam),
+			InMemoryQueue:        v.GetBool(inMemoryQueueParam),
+			Compress:             v.GetBool(CompressParam),
+			InMemoryCapacity:     v.GetUint64(InMemoryCapacityParam),
+			LogCountLimit:        v.GetInt(LogCountLimitParam),
+			DrainInterval:        v.GetInt(DrainIntervalParam),
+			WriteDependencies:    v.GetBool(writeDependenciesParam),
+			DependenciesInterval: v.GetInt(dependenciesIntervalParam),
+			LogFieldsNested:      v.GetBool(logFieldsNestedParam),
+			TagSearchWindowHours: v.GetInt(tagSearchWindowHoursParam),
+			TagSearchNumTraces:   v.GetInt(tagSearchNumTracesParam),
+			TraceLevelSearch:     v.GetBool(traceLevelSearchParam),
+			TraceDuration:        v.GetString(traceDurationParam),
+		}
+		if redactionRules := v.GetString(redactionRulesParam); redactionRules != "" {
+			if err := json.Unmarshal([]byte(redactionRules), &logzioConfig.RedactionRules); err != nil {
+				return nil, errors.Wrapf(err, "can't parse %s", redactionRulesParam)
+			}
+		}
+		if filterRules := v.GetString(filterRulesParam); filterRules != "" {
+			if err := json.Unmarshal([]byte(filterRules), &logzioConfig.FilterRules); err != nil {
+				return nil, errors.Wrapf(err, "can't parse %s", filterRulesParam)
+			}
+		}
+		if extraFields := v.GetString(extraFieldsParam); extraFields != "" {
+			if err := json.Unmarshal([]byte(extraFields), &logzioConfig.ExtraFields); err != nil {
+				return nil, errors.Wrapf(err, "can't parse %s", extraFieldsParam)
+			}
+		}
+		if searchFields := v.GetString(searchFieldsParam); searchFields != "" {
+			if err := json.Unmarshal([]byte(searchFields), &logzioConfig.SearchFields); err != nil {
+				return nil, errors.Wrapf(err, "can't parse %s", searchFieldsParam)
+			}
+		}
+		if tenants := v.GetString(tenantsParam); tenants != "" {
+			if err := json.Unmarshal([]byte(tenants), &logzioConfig.Tenants); err != nil {
+				return nil, errors.Wrapf(err, "can't parse %s", tenantsParam)
+			}
+		}
+		logzioConfig.TenantHeader = v.GetString(tenantHeaderParam)
+		logzioConfig.ArchiveRetentionDays = v.GetInt(archiveRetentionDaysParam)
+		logzioConfig.TagLayout = v.GetString(tagLayoutParam)
+		if tagKeys := v.GetString(tagKeysAsFieldsParam); tagKeys != "" {
+			for _, tagKey := range strings.Split(tagKeys, ",") {
+				logzioConfig.TagKeysAsFields = append(logzioConfig.TagKeysAsFields, strings.TrimSpace(tagKey))
+			}
+		}
+		logzioConfig.TailSampling = TailSamplingConfig{
+			Enabled:                 v.GetBool(tailSamplingParam),
+			DecisionWait:            v.GetInt(tailSamplingDecisionWaitParam),
+			MaxTraces:               v.GetInt(tailSamplingMaxTracesParam),
+			MaxBytes:                v.GetInt(tailSamplingMaxBytesParam),
+			KeepErrors:              v.GetBool(tailSamplingKeepErrorsParam),
+			MinRootDuration:         v.GetString(tailSamplingMinRootDurationParam),
+			BaselineTracesPerSecond: v.GetFloat64(tailSamplingBaselineRateParam),
+		}
+		logzioConfig.SpanLimits = SpanLimits{
+			MaxTagValueLength: v.GetInt(spanMaxTagValueLengthParam),
+			MaxLogs:           v.GetInt(spanMaxLogsParam),
+			MaxLogFields:      v.GetInt(spanMaxLogFieldsParam),
+			MaxDocumentBytes:  v.GetInt(spanMaxDocumentBytesParam),
+		}
+		if services := v.GetString(tailSamplingServicesParam); services != "" {
+			for _, service := range strings.Split(services, ",") {
+				logzioConfig.TailSampling.Services = append(logzioConfig.TailSampling.Services, strings.TrimSpace(service))
+			}
 		}
 	}
 
@@ -177,6 +466,174 @@ func convertEnvironmentVariables() error {
 			return err
 		}
 	}
+	if os.Getenv(writeDependenciesParam) != "" {
+		if param, err := strconv.ParseBool(os.Getenv(writeDependenciesParam)); err == nil {
+			viper.Set(writeDependenciesParam, param)
+		} else {
+			return err
+		}
+	}
+	if os.Getenv(dependenciesIntervalParam) != "" {
+		if param, err := strconv.Atoi(os.Getenv(dependenciesIntervalParam)); err == nil {
+			viper.Set(dependenciesIntervalParam, param)
+		} else {
+			return err
+		}
+	}
+	if os.Getenv(maxSearchWindowHoursParam) != "" {
+		if param, err := strconv.Atoi(os.Getenv(maxSearchWindowHoursParam)); err == nil {
+			viper.Set(maxSearchWindowHoursParam, param)
+		} else {
+			return err
+		}
+	}
+	if os.Getenv(tagSearchWindowHoursParam) != "" {
+		if param, err := strconv.Atoi(os.Getenv(tagSearchWindowHoursParam)); err == nil {
+			viper.Set(tagSearchWindowHoursParam, param)
+		} else {
+			return err
+		}
+	}
+	if os.Getenv(tagSearchNumTracesParam) != "" {
+		if param, err := strconv.Atoi(os.Getenv(tagSearchNumTracesParam)); err == nil {
+			viper.Set(tagSearchNumTracesParam, param)
+		} else {
+			return err
+		}
+	}
+	if os.Getenv(retentionDaysParam) != "" {
+		if param, err := strconv.Atoi(os.Getenv(retentionDaysParam)); err == nil {
+			viper.Set(retentionDaysParam, param)
+		} else {
+			return err
+		}
+	}
+	if os.Getenv(archiveRetentionDaysParam) != "" {
+		if param, err := strconv.Atoi(os.Getenv(archiveRetentionDaysParam)); err == nil {
+			viper.Set(archiveRetentionDaysParam, param)
+		} else {
+			return err
+		}
+	}
+	if os.Getenv(fetchConcurrencyParam) != "" {
+		if param, err := strconv.Atoi(os.Getenv(fetchConcurrencyParam)); err == nil {
+			viper.Set(fetchConcurrencyParam, param)
+		} else {
+			return err
+		}
+	}
+	if os.Getenv(queryTimeoutParam) != "" {
+		if param, err := strconv.Atoi(os.Getenv(queryTimeoutParam)); err == nil {
+			viper.Set(queryTimeoutParam, param)
+		} else {
+			return err
+		}
+	}
+	if os.Getenv(selfTracingParam) != "" {
+		if param, err := strconv.ParseBool(os.Getenv(selfTracingParam)); err == nil {
+			viper.Set(selfTracingParam, param)
+		} else {
+			return err
+		}
+	}
+	if os.Getenv(selfTracingRateParam) != "" {
+		if param, err := strconv.ParseFloat(os.Getenv(selfTracingRateParam), 64); err == nil {
+			viper.Set(selfTracingRateParam, param)
+		} else {
+			return err
+		}
+	}
+	if os.Getenv(logFieldsNestedParam) != "" {
+		if param, err := strconv.ParseBool(os.Getenv(logFieldsNestedParam)); err == nil {
+			viper.Set(logFieldsNestedParam, param)
+		} else {
+			return err
+		}
+	}
+	if os.Getenv(traceLevelSearchParam) != "" {
+		if param, err := strconv.ParseBool(os.Getenv(traceLevelSearchParam)); err == nil {
+			viper.Set(traceLevelSearchParam, param)
+		} else {
+			return err
+		}
+	}
+	if os.Getenv(tailSamplingParam) != "" {
+		if param, err := strconv.ParseBool(os.Getenv(tailSamplingParam)); err == nil {
+			viper.Set(tailSamplingParam, param)
+		} else {
+			return err
+		}
+	}
+	if os.Getenv(tailSamplingDecisionWaitParam) != "" {
+		if param, err := strconv.Atoi(os.Getenv(tailSamplingDecisionWaitParam)); err == nil {
+			viper.Set(tailSamplingDecisionWaitParam, param)
+		} else {
+			return err
+		}
+	}
+	if os.Getenv(tailSamplingMaxTracesParam) != "" {
+		if param, err := strconv.Atoi(os.Getenv(tailSamplingMaxTracesParam)); err == nil {
+			viper.Set(tailSamplingMaxTracesParam, param)
+		} else {
+			return err
+		}
+	}
+	if os.Getenv(tailSamplingMaxBytesParam) != "" {
+		if param, err := strconv.Atoi(os.Getenv(tailSamplingMaxBytesParam)); err == nil {
+			viper.Set(tailSamplingMaxBytesParam, param)
+		} else {
+			return err
+		}
+	}
+	if os.Getenv(tailSamplingKeepErrorsParam) != "" {
+		if param, err := strconv.ParseBool(os.Getenv(tailSamplingKeepErrorsParam)); err == nil {
+			viper.Set(tailSamplingKeepErrorsParam, param)
+		} else {
+			return err
+		}
+	}
+	if os.Getenv(tailSamplingBaselineRateParam) != "" {
+		if param, err := strconv.ParseFloat(os.Getenv(tailSamplingBaselineRateParam), 64); err == nil {
+			viper.Set(tailSamplingBaselineRateParam, param)
+		} else {
+			return err
+		}
+	}
+	if os.Getenv(spanMaxTagValueLengthParam) != "" {
+		if param, err := strconv.Atoi(os.Getenv(spanMaxTagValueLengthParam)); err == nil {
+			viper.Set(spanMaxTagValueLengthParam, param)
+		} else {
+			return err
+		}
+	}
+	if os.Getenv(spanMaxLogsParam) != "" {
+		if param, err := strconv.Atoi(os.Getenv(spanMaxLogsParam)); err == nil {
+			viper.Set(spanMaxLogsParam, param)
+		} else {
+			return err
+		}
+	}
+	if os.Getenv(spanMaxLogFieldsParam) != "" {
+		if param, err := strconv.Atoi(os.Getenv(spanMaxLogFieldsParam)); err == nil {
+			viper.Set(spanMaxLogFieldsParam, param)
+		} else {
+			return err
+		}
+	}
+	if os.Getenv(spanMaxDocumentBytesParam) != "" {
+		if param, err := strconv.Atoi(os.Getenv(spanMaxDocumentBytesParam)); err == nil {
+			viper.Set(spanMaxDocumentBytesParam, param)
+		} else {
+			return err
+		}
+	}
+	if os.Getenv(apiRequestsPerSecondParam) != "" {
+		if param, err := strconv.ParseFloat(os.Getenv(apiRequestsPerSecondParam), 64); err == nil {
+			viper.Set(apiRequestsPerSecondParam, param)
+		} else {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -196,6 +653,20 @@ func (config *LogzioConfig) APIURL() string {
 	return fmt.Sprintf("https://api%s.logz.io/v1/elasticsearch/_msearch", config.regionCode())
 }
 
+func (config *LogzioConfig) archiveAccountToken() string {
+	if config.ArchiveAccountToken != "" {
+		return config.ArchiveAccountToken
+	}
+	return config.AccountToken
+}
+
+func (config *LogzioConfig) archiveAPIToken() string {
+	if config.ArchiveAPIToken != "" {
+		return config.ArchiveAPIToken
+	}
+	return config.APIToken
+}
+
 func (config *LogzioConfig) regionCode() string {
 	regionCode := ""
 	if config.Region != "" && strings.ToLower(config.Region) != usRegionCode {
@@ -213,6 +684,122 @@ func (config *LogzioConfig) drainIntervalToDuration() time.Duration {
 
 }
 
+func (config *LogzioConfig) dependenciesIntervalToDuration() time.Duration {
+	if config.DependenciesInterval > 0 {
+		return time.Second * time.Duration(config.DependenciesInterval)
+	}
+	return time.Second * defaultDependenciesInterval
+}
+
+func (config *LogzioConfig) maxSearchWindow() time.Duration {
+	if config.MaxSearchWindowHours > 0 {
+		return time.Hour * time.Duration(config.MaxSearchWindowHours)
+	}
+	return time.Hour * defaultMaxSearchWindowHours
+}
+
+// tagSearchWindow returns how far back searches without a service are searched, it is never longer than the search window
+func (config *LogzioConfig) tagSearchWindow() time.Duration {
+	window := time.Hour * defaultTagSearchWindowHours
+	if config.TagSearchWindowHours > 0 {
+		window = time.Hour * time.Duration(config.TagSearchWindowHours)
+	}
+	if window > config.maxSearchWindow() {
+		return config.maxSearchWindow()
+	}
+	return window
+}
+
+func (config *LogzioConfig) traceDuration() string {
+	if config.TraceDuration == "" {
+		return traceDurationSpan
+	}
+	return config.TraceDuration
+}
+
+func (config *LogzioConfig) tagSearchNumTraces() int {
+	if config.TagSearchNumTraces > 0 {
+		return config.TagSearchNumTraces
+	}
+	return defaultTagSearchNumTraces
+}
+
+// traceLookupWindow returns how far back a trace is looked up by its id, it is never shorter than the search window
+func (config *LogzioConfig) traceLookupWindow() time.Duration {
+	retention := time.Hour * 24 * time.Duration(config.RetentionDays)
+	if retention > config.maxSearchWindow() {
+		return retention
+	}
+	return config.maxSearchWindow()
+}
+
+// archiveLookupWindow returns how far back an archived trace is looked up by its id
+func (config *LogzioConfig) archiveLookupWindow() time.Duration {
+	if config.ArchiveRetentionDays > 0 {
+		return time.Hour * 24 * time.Duration(config.ArchiveRetentionDays)
+	}
+	return config.traceLookupWindow()
+}
+
+func (config *LogzioConfig) fetchConcurrency() int {
+	if config.FetchConcurrency > 0 {
+		return config.FetchConcurrency
+	}
+	return defaultFetchConcurrency
+}
+
+func (config *LogzioConfig) queryTimeout() time.Duration {
+	if config.QueryTimeout > 0 {
+		return time.Second * time.Duration(config.QueryTimeout)
+	}
+	return time.Second * defaultQueryTimeout
+}
+
+func (config *LogzioConfig) apiRequestsPerSecond() float64 {
+	if config.APIRequestsPerSecond > 0 {
+		return config.APIRequestsPerSecond
+	}
+	return defaultAPIRequestsPerSecond
+}
+
+func (config *LogzioConfig) selfTracingRate() float64 {
+	if config.SelfTracingRate > 0 && config.SelfTracingRate <= 1 {
+		return config.SelfTracingRate
+	}
+	return defaultSelfTracingRate
+}
+
+func (config *LogzioConfig) tailSamplingDecisionWait() time.Duration {
+	if config.TailSampling.DecisionWait > 0 {
+		return time.Second * time.Duration(config.TailSampling.DecisionWait)
+	}
+	return time.Second * defaultTailSamplingDecisionWait
+}
+
+func (config *LogzioConfig) tailSamplingMaxTraces() int {
+	if config.TailSampling.MaxTraces > 0 {
+		return config.TailSampling.MaxTraces
+	}
+	return defaultTailSamplingMaxTraces
+}
+
+func (config *LogzioConfig) tailSamplingMaxBytes() int {
+	if config.TailSampling.MaxBytes > 0 {
+		return config.TailSampling.MaxBytes
+	}
+	return defaultTailSamplingMaxBytes
+}
+
+func (config *LogzioConfig) tagLayout() objects.TagLayout {
+	switch config.TagLayout {
+	case tagLayoutKeysAsFields:
+		return objects.TagLayout{TagKeysAsFields: config.TagKeysAsFields}
+	case tagLayoutNested:
+		return objects.TagLayout{}
+	}
+	return objects.DefaultTagLayout
+}
+
 func (config *LogzioConfig) defaultLogCountLimit() int {
 	if config.LogCountLimit != 0 {
 		return config.LogCountLimit
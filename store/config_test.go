@@ -3,10 +3,12 @@ package store
 import (
 	"fmt"
 	"github.com/hashicorp/go-hclog"
+	"github.com/logzio/jaeger-logzio/store/objects"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 const (
@@ -76,7 +78,19 @@ func TestDefaultValues(tester *testing.T) {
 	assert.Equal(tester, logzioConfig.InMemoryQueue, false)
 	assert.Equal(tester, logzioConfig.InMemoryCapacity, uint64(20*1024*1024))
 	assert.Equal(tester, logzioConfig.Compress, true)
-
+	assert.Equal(tester, logzioConfig.WriteDependencies, false)
+	assert.Equal(tester, logzioConfig.DependenciesInterval, 60)
+	assert.Equal(tester, logzioConfig.MaxSearchWindowHours, 48)
+	assert.Equal(tester, logzioConfig.FetchConcurrency, 4)
+	assert.Equal(tester, logzioConfig.QueryTimeout, 60)
+	assert.Equal(tester, logzioConfig.APIRequestsPerSecond, float64(10))
+	assert.Equal(tester, logzioConfig.SelfTracingRate, 1.0)
+	assert.Equal(tester, logzioConfig.TailSampling.DecisionWait, 10)
+	assert.Equal(tester, logzioConfig.TailSampling.MaxTraces, 50000)
+	assert.Equal(tester, logzioConfig.TailSampling.MaxBytes, 268435456)
+	assert.Equal(tester, logzioConfig.TailSampling.KeepErrors, true)
+	assert.Equal(tester, logzioConfig.SpanLimits, SpanLimits{MaxDocumentBytes: 500000})
+	assert.Equal(tester, logzioConfig.TagLayout, "allAsFields")
 }
 func TestRegion(tester *testing.T) {
 	config := LogzioConfig{
@@ -136,6 +150,8 @@ func TestParseConfig(tester *testing.T) {
 	assert.Equal(tester, config.InMemoryCapacity, uint64(500))
 	assert.Equal(tester, config.LogCountLimit, 500)
 	assert.Equal(tester, config.DrainInterval, 5)
+	assert.Equal(tester, config.WriteDependencies, true)
+	assert.Equal(tester, config.DependenciesInterval, 30)
 	config, err = ParseConfig("fixtures/invalid.yaml", logger)
 	assert.Equal(tester, config.LogCountLimit, 500000)
 	assert.Equal(tester, config.InMemoryQueue, false)
@@ -151,6 +167,12 @@ func TestEnvironmentVars(tester *testing.T) {
 	os.Setenv(InMemoryCapacityParam, "500")
 	os.Setenv(LogCountLimitParam, "500")
 	os.Setenv(DrainIntervalParam, "5")
+	os.Setenv(maxSearchWindowHoursParam, "168")
+	os.Setenv(retentionDaysParam, "30")
+	os.Setenv(archiveRetentionDaysParam, "365")
+	os.Setenv(apiRequestsPerSecondParam, "2.5")
+	os.Setenv(tagSearchWindowHoursParam, "12")
+	os.Setenv(tagSearchNumTracesParam, "50")
 
 	config, err := ParseConfig("", logger)
 	assert.NoError(tester, err)
@@ -159,6 +181,13 @@ func TestEnvironmentVars(tester *testing.T) {
 	assert.Equal(tester, config.InMemoryCapacity, uint64(500))
 	assert.Equal(tester, config.LogCountLimit, 500)
 	assert.Equal(tester, config.DrainInterval, 5)
+	assert.Equal(tester, config.MaxSearchWindowHours, 168)
+	assert.Equal(tester, config.RetentionDays, 30)
+	assert.Equal(tester, config.ArchiveRetentionDays, 365)
+	assert.Equal(tester, config.traceLookupWindow(), time.Hour*24*30)
+	assert.Equal(tester, config.APIRequestsPerSecond, 2.5)
+	assert.Equal(tester, config.tagSearchWindow(), time.Hour*12)
+	assert.Equal(tester, config.TagSearchNumTraces, 50)
 
 	os.Setenv(customQueueDirParam, "/tmp")
 	os.Setenv(accountTokenParam, "fake")
@@ -167,6 +196,11 @@ func TestEnvironmentVars(tester *testing.T) {
 	os.Setenv(InMemoryCapacityParam, "")
 	os.Setenv(LogCountLimitParam, "")
 	os.Setenv(DrainIntervalParam, "")
+	os.Setenv(maxSearchWindowHoursParam, "")
+	os.Setenv(retentionDaysParam, "")
+	os.Setenv(apiRequestsPerSecondParam, "")
+	os.Setenv(tagSearchWindowHoursParam, "")
+	os.Setenv(tagSearchNumTracesParam, "")
 	config, err = ParseConfig("", logger)
 	assert.NoError(tester, err)
 	assert.Equal(tester, config.InMemoryQueue, false)
@@ -174,6 +208,10 @@ func TestEnvironmentVars(tester *testing.T) {
 	assert.Equal(tester, config.InMemoryCapacity, uint64(20*1024*1024))
 	assert.Equal(tester, config.LogCountLimit, 500000)
 	assert.Equal(tester, config.DrainInterval, 3)
+	assert.Equal(tester, config.MaxSearchWindowHours, 48)
+	assert.Equal(tester, config.traceLookupWindow(), time.Hour*48)
+	assert.Equal(tester, config.tagSearchWindow(), time.Hour*6)
+	assert.Equal(tester, config.TagSearchNumTraces, 20)
 
 	os.Unsetenv(customQueueDirParam)
 	os.Unsetenv(accountTokenParam)
@@ -181,6 +219,124 @@ func TestEnvironmentVars(tester *testing.T) {
 	os.Unsetenv(CompressParam)
 	os.Unsetenv(InMemoryCapacityParam)
 	os.Unsetenv(LogCountLimitParam)
+	os.Unsetenv(apiRequestsPerSecondParam)
 	os.Unsetenv(DrainIntervalParam)
+	os.Unsetenv(maxSearchWindowHoursParam)
+	os.Unsetenv(retentionDaysParam)
+	os.Unsetenv(archiveRetentionDaysParam)
+	os.Unsetenv(tagSearchWindowHoursParam)
+	os.Unsetenv(tagSearchNumTracesParam)
+
+}
+
+func TestRedactionRulesEnvironmentVar(tester *testing.T) {
+	os.Setenv(accountTokenParam, "fake")
+	os.Setenv(redactionRulesParam, `[{"key":"db.statement","action":"drop"},{"keyRegex":"^user\\.","scopes":["span"],"action":"hash"}]`)
+	defer os.Unsetenv(accountTokenParam)
+	defer os.Unsetenv(redactionRulesParam)
+
+	config, err := ParseConfig("", logger)
+	assert.NoError(tester, err)
+	assert.Equal(tester, []RedactionRule{
+		{Key: "db.statement", Action: redactionActionDrop},
+		{KeyRegex: `^user\.`, Scopes: []string{redactionScopeSpan}, Action: redactionActionHash},
+	}, config.RedactionRules)
+
+	os.Setenv(redactionRulesParam, `[{"key":"db.statement","action":"encrypt"}]`)
+	_, err = ParseConfig("", logger)
+	assert.Error(tester, err)
+}
+
+func TestTailSamplingEnvironmentVars(tester *testing.T) {
+	os.Setenv(accountTokenParam, "fake")
+	os.Setenv(tailSamplingParam, "true")
+	os.Setenv(tailSamplingDecisionWaitParam, "30")
+	os.Setenv(tailSamplingMaxBytesParam, "1048576")
+	os.Setenv(tailSamplingKeepErrorsParam, "false")
+	os.Setenv(tailSamplingMinRootDurationParam, "1500ms")
+	os.Setenv(tailSamplingServicesParam, "payments, checkout")
+	defer os.Unsetenv(accountTokenParam)
+	defer os.Unsetenv(tailSamplingParam)
+	defer os.Unsetenv(tailSamplingDecisionWaitParam)
+	defer os.Unsetenv(tailSamplingMaxBytesParam)
+	defer os.Unsetenv(tailSamplingKeepErrorsParam)
+	defer os.Unsetenv(tailSamplingMinRootDurationParam)
+	defer os.Unsetenv(tailSamplingServicesParam)
+
+	config, err := ParseConfig("", logger)
+	assert.NoError(tester, err)
+	assert.Equal(tester, TailSamplingConfig{
+		Enabled:                 true,
+		DecisionWait:            30,
+		MaxTraces:               defaultTailSamplingMaxTraces,
+		MaxBytes:                1048576,
+		KeepErrors:              false,
+		MinRootDuration:         "1500ms",
+		Services:                []string{"payments", "checkout"},
+		BaselineTracesPerSecond: defaultTailSamplingBaselineRate,
+	}, config.TailSampling)
+
+	os.Setenv(tailSamplingMinRootDurationParam, "long")
+	_, err = ParseConfig("", logger)
+	assert.Error(tester, err)
+}
+
+func TestExtraFieldsEnvironmentVars(tester *testing.T) {
+	os.Setenv(accountTokenParam, "fake")
+	os.Setenv(extraFieldsParam, `{"cluster":"prod-eu","env":"production"}`)
+	os.Setenv(searchFieldsParam, `{"env":"production"}`)
+	defer os.Unsetenv(accountTokenParam)
+	defer os.Unsetenv(extraFieldsParam)
+	defer os.Unsetenv(searchFieldsParam)
+
+	config, err := ParseConfig("", logger)
+	assert.NoError(tester, err)
+	assert.Equal(tester, map[string]string{"cluster": "prod-eu", "env": "production"}, config.ExtraFields)
+	assert.Equal(tester, map[string]string{"env": "production"}, config.SearchFields)
+
+	os.Setenv(extraFieldsParam, `{"type":"custom"}`)
+	_, err = ParseConfig("", logger)
+	assert.Error(tester, err)
+}
+
+func TestTagLayoutEnvironmentVars(tester *testing.T) {
+	os.Setenv(accountTokenParam, "fake")
+	os.Setenv(tagLayoutParam, tagLayoutKeysAsFields)
+	os.Setenv(tagKeysAsFieldsParam, "http.status_code, error")
+	os.Setenv(logFieldsNestedParam, "true")
+	defer os.Unsetenv(accountTokenParam)
+	defer os.Unsetenv(tagLayoutParam)
+	defer os.Unsetenv(tagKeysAsFieldsParam)
+	defer os.Unsetenv(logFieldsNestedParam)
+
+	config, err := ParseConfig("", logger)
+	assert.NoError(tester, err)
+	assert.Equal(tester, objects.TagLayout{TagKeysAsFields: []string{"http.status_code", "error"}}, config.tagLayout())
+	assert.True(tester, config.LogFieldsNested)
+
+	os.Unsetenv(tagKeysAsFieldsParam)
+	_, err = ParseConfig("", logger)
+	assert.Error(tester, err)
+
+	os.Setenv(tagLayoutParam, "flat")
+	_, err = ParseConfig("", logger)
+	assert.Error(tester, err)
+}
+
+func TestTraceSearchEnvironmentVars(tester *testing.T) {
+	os.Setenv(accountTokenParam, "fake")
+	os.Setenv(traceLevelSearchParam, "true")
+	os.Setenv(traceDurationParam, traceDurationRoot)
+	defer os.Unsetenv(accountTokenParam)
+	defer os.Unsetenv(traceLevelSearchParam)
+	defer os.Unsetenv(traceDurationParam)
+
+	config, err := ParseConfig("", logger)
+	assert.NoError(tester, err)
+	assert.True(tester, config.TraceLevelSearch)
+	assert.Equal(tester, traceDurationRoot, config.traceDuration())
 
+	os.Setenv(traceDurationParam, "longest")
+	_, err = ParseConfig("", logger)
+	assert.Error(tester, err)
 }
@@ -0,0 +1,182 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/pkg/cache"
+	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
+	"github.com/logzio/jaeger-logzio/store/objects"
+)
+
+const (
+	errorTagKey = "error"
+	// how many flushes a child span waits for its parent span before it is dropped
+	maxPendingFlushes      = 2
+	maxPendingDependencies = 100000
+	spanServiceCacheSize   = 500000
+)
+
+type dependencyCount struct {
+	calls  uint64
+	errors uint64
+}
+
+// pendingDependency is a child span whose parent span was not written yet
+type pendingDependency struct {
+	parentKey string
+	child     string
+	isError   bool
+	flushes   int
+}
+
+// dependencyAggregator counts parent -> child service calls of the written spans and periodically
+// sends the counts of the last interval as jaegerDependency documents
+type dependencyAggregator struct {
+	logger        hclog.Logger
+	interval      time.Duration
+	send          func([]byte) error
+	spanServices  cache.Cache
+	lock          sync.Mutex
+	counts        map[dependencyKey]*dependencyCount
+	pending       []pendingDependency
+	intervalStart time.Time
+	stop          chan struct{}
+	done          chan struct{}
+}
+
+func newDependencyAggregator(interval time.Duration, send func([]byte) error, logger hclog.Logger) *dependencyAggregator {
+	return &dependencyAggregator{
+		logger:   logger,
+		interval: interval,
+		send:     send,
+		spanServices: cache.NewLRUWithOptions(
+			spanServiceCacheSize,
+			&cache.Options{
+				TTL: maxPendingFlushes * interval,
+			},
+		),
+		counts:        make(map[dependencyKey]*dependencyCount),
+		intervalStart: time.Now(),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+func (aggregator *dependencyAggregator) start() {
+	go func() {
+		defer close(aggregator.done)
+		ticker := time.NewTicker(aggregator.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				aggregator.flush()
+			case <-aggregator.stop:
+				aggregator.flush()
+				return
+			}
+		}
+	}()
+}
+
+// close stops the flush loop after sending the counts of the current interval
+func (aggregator *dependencyAggregator) close() {
+	close(aggregator.stop)
+	<-aggregator.done
+}
+
+func modelSpanKey(traceID model.TraceID, spanID model.SpanID) string {
+	return spanKey(dbmodel.TraceID(traceID.String()), dbmodel.SpanID(spanID.String()))
+}
+
+func isErrorSpan(span *model.Span) bool {
+	for _, tag := range span.Tags {
+		if tag.Key == errorTagKey {
+			return tag.Bool() || tag.AsString() == "true"
+		}
+	}
+	return false
+}
+
+func (aggregator *dependencyAggregator) add(span *model.Span) {
+	child := span.Process.ServiceName
+	aggregator.spanServices.Put(modelSpanKey(span.TraceID, span.SpanID), child)
+	isError := isErrorSpan(span)
+	seenParents := make(map[string]bool)
+
+	aggregator.lock.Lock()
+	defer aggregator.lock.Unlock()
+	for _, ref := range span.References {
+		parentKey := modelSpanKey(ref.TraceID, ref.SpanID)
+		if seenParents[parentKey] {
+			continue
+		}
+		seenParents[parentKey] = true
+		if !aggregator.countCall(parentKey, child, isError) {
+			if len(aggregator.pending) >= maxPendingDependencies {
+				aggregator.logger.Warn("too many spans are waiting for their parent span, dropping dependency")
+				continue
+			}
+			aggregator.pending = append(aggregator.pending, pendingDependency{parentKey: parentKey, child: child, isError: isError})
+		}
+	}
+}
+
+// countCall returns false if the parent span service is unknown, must be called with the lock held
+func (aggregator *dependencyAggregator) countCall(parentKey string, child string, isError bool) bool {
+	parent, ok := aggregator.spanServices.Get(parentKey).(string)
+	if !ok {
+		return false
+	}
+	if parent == child {
+		return true
+	}
+	key := dependencyKey{parent: parent, child: child}
+	count, ok := aggregator.counts[key]
+	if !ok {
+		count = &dependencyCount{}
+		aggregator.counts[key] = count
+	}
+	count.calls++
+	if isError {
+		count.errors++
+	}
+	return true
+}
+
+func (aggregator *dependencyAggregator) flush() {
+	aggregator.lock.Lock()
+	var stillPending []pendingDependency
+	for _, pending := range aggregator.pending {
+		if aggregator.countCall(pending.parentKey, pending.child, pending.isError) {
+			continue
+		}
+		pending.flushes++
+		if pending.flushes < maxPendingFlushes {
+			stillPending = append(stillPending, pending)
+		}
+	}
+	aggregator.pending = stillPending
+	counts := aggregator.counts
+	intervalStart := aggregator.intervalStart
+	aggregator.counts = make(map[dependencyKey]*dependencyCount)
+	aggregator.intervalStart = time.Now()
+	aggregator.lock.Unlock()
+
+	for key, count := range counts {
+		dependency := objects.NewLogzioDependency(key.parent, key.child, count.calls, count.errors, intervalStart, aggregator.interval)
+		dependencyBytes, err := json.Marshal(dependency)
+		if err != nil {
+			aggregator.logger.Warn(fmt.Sprintf("can't marshal dependency %s -> %s: %s", key.parent, key.child, err.Error()))
+			continue
+		}
+		if err = aggregator.send(dependencyBytes); err != nil {
+			aggregator.logger.Warn(fmt.Sprintf("can't send dependency %s -> %s: %s", key.parent, key.child, err.Error()))
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+)
+
+const (
+	typeField        = "type"
+	spanIDField      = "spanID"
+	referencesField  = "references"
+	spanDocumentType = "jaegerSpan"
+
+	dependencyDocumentType = "jaegerDependency"
+	parentServiceField     = "parentService"
+	childServiceField      = "childService"
+	callCountField         = "callCount"
+)
+
+// DependencyFinder computes the service dependency graph from the spans stored in logz.io
+type DependencyFinder struct {
+	logger hclog.Logger
+	reader *LogzioSpanReader
+}
+
+// NewDependencyFinder creates dependency finder object
+func NewDependencyFinder(reader *LogzioSpanReader) *DependencyFinder {
+	return &DependencyFinder{
+		logger: reader.logger,
+		reader: reader,
+	}
+}
+
+// dependencySpan holds only the span fields needed to resolve parent -> child service calls
+type dependencySpan struct {
+	TraceID    dbmodel.TraceID     `json:"traceID"`
+	SpanID     dbmodel.SpanID      `json:"spanID"`
+	StartTime  uint64              `json:"startTime"`
+	References []dbmodel.Reference `json:"references"`
+	Process    struct {
+		ServiceName string `json:"serviceName"`
+	} `json:"process"`
+}
+
+type dependencyKey struct {
+	parent string
+	child  string
+}
+
+func spanKey(traceID dbmodel.TraceID, spanID dbmodel.SpanID) string {
+	return fmt.Sprintf("%s:%s", traceID, spanID)
+}
+
+// getDependencies returns the precomputed dependencies written by the span writer if there are any in the time range,
+// otherwise it computes the dependencies from the raw spans
+func (finder *DependencyFinder) getDependencies(ctx context.Context, startTime, endTime time.Time) ([]model.DependencyLink, error) {
+	links, err := finder.getPrecomputedDependencies(ctx, startTime, endTime)
+	if err != nil {
+		finder.logger.Warn(fmt.Sprintf("can't get precomputed dependencies, computing from spans: %s", err.Error()))
+	} else if len(links) > 0 {
+		return links, nil
+	}
+	return finder.computeDependencies(ctx, startTime, endTime)
+}
+
+func (finder *DependencyFinder) getPrecomputedDependencies(ctx context.Context, startTime, endTime time.Time) ([]model.DependencyLink, error) {
+	callCounts := make(map[dependencyKey]uint64)
+	for _, window := range splitTimeWindow(startTime, endTime, time.Hour*apiSearchWindowHours) {
+		if err := finder.countPrecomputedDependencies(ctx, window, callCounts); err != nil {
+			return nil, err
+		}
+	}
+	return dependencyLinksFromCounts(callCounts), nil
+}
+
+func (finder *DependencyFinder) countPrecomputedDependencies(ctx context.Context, window timeWindow, callCounts map[dependencyKey]uint64) error {
+	query := elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery(typeField, dependencyDocumentType),
+		buildStartTimeQuery(window.startTime, window.endTime)).
+		Filter(finder.reader.searchFields...)
+	aggregation := elastic.NewTermsAggregation().
+		Field(parentServiceField).
+		Size(logzioMaxAggregationSize).
+		SubAggregation(childServiceField, elastic.NewTermsAggregation().
+			Field(childServiceField).
+			Size(logzioMaxAggregationSize).
+			SubAggregation(callCountField, elastic.NewSumAggregation().Field(callCountField)))
+	requestBody, err := elastic.NewSearchRequest().
+		Size(0).
+		IgnoreUnavailable(true).
+		Query(query).
+		Aggregation(parentServiceField, aggregation).
+		Body()
+	if err != nil {
+		return errors.Wrap(err, "can't create search request for precomputed dependencies")
+	}
+	searchResult, err := finder.reader.getSearchResult(ctx, fmt.Sprintf("{}\n%s\n", requestBody))
+	if err != nil {
+		return err
+	}
+	if searchResult == nil || searchResult.Aggregations == nil {
+		return nil
+	}
+	parentBuckets, found := searchResult.Aggregations.Terms(parentServiceField)
+	if !found {
+		return nil
+	}
+
+	for _, parentBucket := range parentBuckets.Buckets {
+		childBuckets, found := parentBucket.Terms(childServiceField)
+		if !found {
+			continue
+		}
+		for _, childBucket := range childBuckets.Buckets {
+			callCount, found := childBucket.Sum(callCountField)
+			if !found || callCount.Value == nil {
+				continue
+			}
+			key := dependencyKey{parent: fmt.Sprint(parentBucket.Key), child: fmt.Sprint(childBucket.Key)}
+			callCounts[key] += uint64(*callCount.Value)
+		}
+	}
+	return nil
+}
+
+func (finder *DependencyFinder) computeDependencies(ctx context.Context, startTime, endTime time.Time) ([]model.DependencyLink, error) {
+	spans := make(map[string]*dependencySpan)
+	for _, window := range splitTimeWindow(startTime, endTime, time.Hour*apiSearchWindowHours) {
+		if err := finder.collectDependencySpans(ctx, window, spans); err != nil {
+			return nil, err
+		}
+	}
+	finder.logger.Debug(fmt.Sprintf("computing dependencies from %d spans", len(spans)))
+	return buildDependencyLinks(spans), nil
+}
+
+func (finder *DependencyFinder) dependencySpansRequestBody(fromTime, toTime uint64) (string, error) {
+	query := elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery(typeField, spanDocumentType),
+		elastic.NewRangeQuery(startTimeField).Gte(fromTime).Lte(toTime)).
+		Filter(finder.reader.searchFields...)
+	source := elastic.NewSearchSource().
+		Query(query).
+		Size(defaultDocCount).
+		Sort(startTimeField, true).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).
+			Include(traceIDField, spanIDField, startTimeField, referencesField, serviceNameField))
+	requestBody, err := elastic.NewSearchRequest().
+		IgnoreUnavailable(true).
+		Source(source).
+		Body()
+	if err != nil {
+		return "", errors.Wrap(err, "can't create search request for dependencies")
+	}
+	return fmt.Sprintf("{}\n%s\n", requestBody), nil
+}
+
+// collectDependencySpans pages through all the spans in the time range, ordered by start time.
+// Each page starts at the start time of the last span of the previous one, spans on the page boundary are
+// fetched twice and deduplicated by their trace and span ids.
+func (finder *DependencyFinder) collectDependencySpans(ctx context.Context, window timeWindow, spans map[string]*dependencySpan) error {
+	fromTime := model.TimeAsEpochMicroseconds(window.startTime)
+	toTime := model.TimeAsEpochMicroseconds(window.endTime)
+	for page := 1; ; page++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		requestBody, err := finder.dependencySpansRequestBody(fromTime, toTime)
+		if err != nil {
+			return err
+		}
+		result, err := finder.reader.getSearchResult(ctx, requestBody)
+		if err != nil {
+			return errors.Wrap(err, "failed to search spans for dependencies")
+		}
+		if result == nil || result.Hits == nil || len(result.Hits.Hits) == 0 {
+			break
+		}
+		lastStartTime := fromTime
+		for _, hit := range result.Hits.Hits {
+			span, err := unmarshalDependencySpan(hit)
+			if err != nil {
+				finder.logger.Warn(fmt.Sprintf("can't parse span for dependencies, skipping: %s", err.Error()))
+				continue
+			}
+			spans[spanKey(span.TraceID, span.SpanID)] = span
+			lastStartTime = span.StartTime
+		}
+		finder.logger.Debug(fmt.Sprintf("dependencies page %d: got %d spans", page, len(result.Hits.Hits)))
+		if len(result.Hits.Hits) < defaultDocCount {
+			break
+		}
+		if lastStartTime <= fromTime {
+			// the whole page shares the same start time, step over it so we don't page forever
+			finder.logger.Warn(fmt.Sprintf("more than %d spans start at %d, some dependencies may be missing", defaultDocCount, fromTime))
+			lastStartTime = fromTime + 1
+		}
+		fromTime = lastStartTime
+	}
+	return nil
+}
+
+func unmarshalDependencySpan(hit *elastic.SearchHit) (*dependencySpan, error) {
+	if hit.Source == nil {
+		return nil, errors.New("empty search hit source")
+	}
+	var span dependencySpan
+	if err := json.Unmarshal(*hit.Source, &span); err != nil {
+		return nil, err
+	}
+	return &span, nil
+}
+
+// buildDependencyLinks counts the calls between every parent service and child service pair.
+// A span is counted once for every distinct parent span it references which belongs to a different service
+func buildDependencyLinks(spans map[string]*dependencySpan) []model.DependencyLink {
+	callCounts := make(map[dependencyKey]uint64)
+	for _, span := range spans {
+		seenParents := make(map[string]bool)
+		for _, ref := range span.References {
+			if ref.RefType != dbmodel.ChildOf && ref.RefType != dbmodel.FollowsFrom {
+				continue
+			}
+			refTraceID := ref.TraceID
+			if refTraceID == "" {
+				refTraceID = span.TraceID
+			}
+			parentKey := spanKey(refTraceID, ref.SpanID)
+			if seenParents[parentKey] {
+				continue
+			}
+			seenParents[parentKey] = true
+			parent, ok := spans[parentKey]
+			if !ok || parent.Process.ServiceName == span.Process.ServiceName {
+				continue
+			}
+			callCounts[dependencyKey{parent: parent.Process.ServiceName, child: span.Process.ServiceName}]++
+		}
+	}
+	return dependencyLinksFromCounts(callCounts)
+}
+
+func dependencyLinksFromCounts(callCounts map[dependencyKey]uint64) []model.DependencyLink {
+	links := make([]model.DependencyLink, 0, len(callCounts))
+	for key, count := range callCounts {
+		links = append(links, model.DependencyLink{
+			Parent:    key.parent,
+			Child:     key.child,
+			CallCount: count,
+		})
+	}
+	sortDependencyLinks(links)
+	return links
+}
+
+func sortDependencyLinks(links []model.DependencyLink) {
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].Parent != links[j].Parent {
+			return links[i].Parent < links[j].Parent
+		}
+		return links[i].Child < links[j].Child
+	})
+}
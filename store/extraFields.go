@@ -0,0 +1,77 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+)
+
+// reservedFieldNames are the top level fields of the span, service and dependency documents
+var reservedFieldNames = map[string]bool{
+	"traceID": true, "spanID": true, "operationName": true, "references": true, "flags": true,
+	"startTime": true, "startTimeMillis": true, "@timestamp": true, "duration": true, "JaegerTags": true,
+	"JaegerTag": true, "logs": true, "process": true, "type": true, "serviceName": true,
+	"parentService": true, "childService": true, "callCount": true, "errorCount": true, "intervalSeconds": true,
+}
+
+// extraFields are top level fields stamped on the written documents and matched by the searches.
+// Values may reference environment variables, for example ${K8S_CLUSTER}
+type extraFields struct {
+	values map[string]string
+	// members holds the fields as json object members, without the enclosing braces
+	members []byte
+}
+
+func newExtraFields(fields map[string]string) (*extraFields, error) {
+	values := make(map[string]string, len(fields))
+	for name, value := range fields {
+		if name == "" || reservedFieldNames[name] {
+			return nil, fmt.Errorf("invalid extra field name %q", name)
+		}
+		expanded := os.ExpandEnv(value)
+		if expanded == "" {
+			return nil, fmt.Errorf("extra field %s has an empty value %q", name, value)
+		}
+		values[name] = expanded
+	}
+	extra := &extraFields{values: values}
+	if len(values) > 0 {
+		// maps are marshaled with sorted keys, so the members are the same for every document
+		object, err := json.Marshal(values)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't marshal extra fields")
+		}
+		extra.members = object[1 : len(object)-1]
+	}
+	return extra, nil
+}
+
+// stamp adds the fields to the top level of a json object document
+func (extra *extraFields) stamp(document []byte) []byte {
+	if len(extra.members) == 0 || len(document) < 2 || document[len(document)-1] != '}' {
+		return document
+	}
+	stamped := make([]byte, 0, len(document)+len(extra.members)+1)
+	stamped = append(stamped, document[:len(document)-1]...)
+	stamped = append(stamped, ',')
+	stamped = append(stamped, extra.members...)
+	return append(stamped, '}')
+}
+
+// queries returns term queries which match the documents stamped with the fields
+func (extra *extraFields) queries() []elastic.Query {
+	names := make([]string, 0, len(extra.values))
+	for name := range extra.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	queries := make([]elastic.Query, 0, len(names))
+	for _, name := range names {
+		queries = append(queries, elastic.NewTermQuery(name, extra.values[name]))
+	}
+	return queries
+}
@@ -0,0 +1,37 @@
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtraFieldsStamp(tester *testing.T) {
+	os.Setenv("TEST_K8S_CLUSTER", "prod-eu")
+	defer os.Unsetenv("TEST_K8S_CLUSTER")
+	extra, err := newExtraFields(map[string]string{"cluster": "${TEST_K8S_CLUSTER}", "env": "production"})
+	assert.NoError(tester, err)
+
+	stamped := extra.stamp([]byte(`{"type":"jaegerSpan"}`))
+	assert.Equal(tester, `{"type":"jaegerSpan","cluster":"prod-eu","env":"production"}`, string(stamped))
+	var document map[string]string
+	assert.NoError(tester, json.Unmarshal(stamped, &document))
+
+	unchanged, err := newExtraFields(nil)
+	assert.NoError(tester, err)
+	assert.Equal(tester, `{"type":"jaegerSpan"}`, string(unchanged.stamp([]byte(`{"type":"jaegerSpan"}`))))
+	assert.Empty(tester, unchanged.queries())
+}
+
+func TestInvalidExtraFields(tester *testing.T) {
+	for _, fields := range []map[string]string{
+		{"type": "custom"},
+		{"": "value"},
+		{"cluster": "${TEST_UNSET_CLUSTER}"},
+	} {
+		_, err := newExtraFields(fields)
+		assert.Error(tester, err, fields)
+	}
+}
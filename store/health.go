@@ -0,0 +1,188 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+)
+
+const (
+	healthPath         = "/health"
+	readyPath          = "/ready"
+	healthCheckTimeout = time.Second * 5
+
+	healthStatusOK      = "ok"
+	healthStatusError   = "error"
+	healthStatusSkipped = "skipped"
+
+	configCheck    = "config"
+	searchAPICheck = "searchAPI"
+	listenerCheck  = "listener"
+	diskQueueCheck = "diskQueue"
+)
+
+// healthCheckResult is the result of a single readiness check
+type healthCheckResult struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// healthResponse is the json body of the health and readiness endpoints
+type healthResponse struct {
+	Status string                       `json:"status"`
+	Checks map[string]healthCheckResult `json:"checks,omitempty"`
+}
+
+// healthChecker probes the connectivity of the plugin to logz.io
+type healthChecker struct {
+	config LogzioConfig
+	store  *Store
+	logger hclog.Logger
+}
+
+// NewHealthHandler returns an http handler which serves liveness on /health and readiness checks on /ready
+func NewHealthHandler(config LogzioConfig, store *Store, logger hclog.Logger) http.Handler {
+	checker := &healthChecker{config: config, store: store, logger: logger}
+	mux := http.NewServeMux()
+	mux.HandleFunc(healthPath, func(rw http.ResponseWriter, req *http.Request) {
+		writeHealthResponse(rw, http.StatusOK, healthResponse{Status: healthStatusOK})
+	})
+	mux.HandleFunc(readyPath, func(rw http.ResponseWriter, req *http.Request) {
+		checks := checker.check(req.Context())
+		response := healthResponse{Status: healthStatusOK, Checks: checks}
+		statusCode := http.StatusOK
+		for _, result := range checks {
+			if result.Status == healthStatusError {
+				response.Status = healthStatusError
+				statusCode = http.StatusServiceUnavailable
+			}
+		}
+		writeHealthResponse(rw, statusCode, response)
+	})
+	return mux
+}
+
+// ServeHealth exposes the health and readiness endpoints on address, it blocks until the listener fails
+func ServeHealth(address string, config LogzioConfig, store *Store, logger hclog.Logger) {
+	logger.Info(fmt.Sprintf("serving health checks on %s%s and %s%s", address, healthPath, address, readyPath))
+	if err := http.ListenAndServe(address, NewHealthHandler(config, store, logger)); err != nil {
+		logger.Error(fmt.Sprintf("health listener failed: %s", err.Error()))
+	}
+}
+
+func writeHealthResponse(rw http.ResponseWriter, statusCode int, response healthResponse) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(statusCode)
+	_ = json.NewEncoder(rw).Encode(response)
+}
+
+// check runs all the readiness checks, each check is limited by the health check timeout
+func (checker *healthChecker) check(ctx context.Context) map[string]healthCheckResult {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	checks := map[string]healthCheckResult{
+		configCheck:    checkResult(checker.checkConfig()),
+		searchAPICheck: checker.checkSearchAPI(ctx),
+		listenerCheck:  checker.checkListener(ctx),
+		diskQueueCheck: checker.checkDiskQueue(),
+	}
+	for name, result := range checks {
+		if result.Status == healthStatusError {
+			checker.logger.Warn(fmt.Sprintf("readiness check %s failed: %s", name, result.Message))
+		}
+	}
+	return checks
+}
+
+func checkResult(err error) healthCheckResult {
+	if err != nil {
+		return healthCheckResult{Status: healthStatusError, Message: err.Error()}
+	}
+	return healthCheckResult{Status: healthStatusOK}
+}
+
+func (checker *healthChecker) checkConfig() error {
+	config := checker.config
+	return config.validate(hclog.NewNullLogger())
+}
+
+// checkSearchAPI performs a search which matches no documents, to verify the api url and token
+func (checker *healthChecker) checkSearchAPI(ctx context.Context) healthCheckResult {
+	if checker.config.APIToken == "" || checker.store == nil || checker.store.reader == nil {
+		return healthCheckResult{Status: healthStatusSkipped, Message: "no api token configured"}
+	}
+	return checkResult(checker.store.reader.probe(ctx))
+}
+
+// checkListener verifies the listener host accepts connections
+func (checker *healthChecker) checkListener(ctx context.Context) healthCheckResult {
+	if checker.config.AccountToken == "" {
+		return healthCheckResult{Status: healthStatusSkipped, Message: "no account token configured"}
+	}
+	listenerURL, err := url.Parse(checker.config.ListenerURL())
+	if err != nil {
+		return checkResult(errors.Wrap(err, "invalid listener url"))
+	}
+	address := listenerURL.Host
+	if listenerURL.Port() == "" {
+		port := "80"
+		if listenerURL.Scheme == "https" {
+			port = "443"
+		}
+		address = net.JoinHostPort(listenerURL.Hostname(), port)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return checkResult(errors.Wrapf(err, "can't reach listener %s", address))
+	}
+	_ = conn.Close()
+	return checkResult(nil)
+}
+
+// checkDiskQueue verifies the disk of the sender queue has free space, the sender drops spans above the threshold
+func (checker *healthChecker) checkDiskQueue() healthCheckResult {
+	if checker.config.InMemoryQueue {
+		return healthCheckResult{Status: healthStatusSkipped, Message: "in memory queue is used"}
+	}
+	if checker.store == nil || checker.store.writer == nil {
+		return healthCheckResult{Status: healthStatusSkipped, Message: "no span writer"}
+	}
+	queueDir := checker.store.writer.sender.queueDir
+	usage, err := queueDiskUsage(queueDir)
+	if err != nil {
+		return checkResult(errors.Wrapf(err, "can't get disk usage of %s", queueDir))
+	}
+	if usage > dropLogsDiskThreshold {
+		return checkResult(errors.Errorf("disk of %s is %.1f%% used, spans are dropped above %d%%", queueDir, usage, dropLogsDiskThreshold))
+	}
+	return healthCheckResult{Status: healthStatusOK, Message: fmt.Sprintf("%.1f%% used", usage)}
+}
+
+// probe performs a single search which matches no documents, without retries
+func (reader *LogzioSpanReader) probe(ctx context.Context) error {
+	requestBody, err := elastic.NewSearchRequest().
+		Size(0).
+		IgnoreUnavailable(true).
+		Query(elastic.NewBoolQuery().Filter(
+			elastic.NewTermQuery(typeField, reader.spanType),
+			buildStartTimeQuery(time.Now().Add(-time.Minute), time.Now()))).
+		Body()
+	if err != nil {
+		return errors.Wrap(err, "can't create probe search request")
+	}
+	req, err := reader.getHTTPRequest(ctx, fmt.Sprintf("{}\n%s\n", requestBody))
+	if err != nil {
+		return err
+	}
+	_, err = reader.getHTTPResponseBytes(req)
+	return err
+}
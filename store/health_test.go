@@ -0,0 +1,80 @@
+package store
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getHealthResponse(tester *testing.T, handler http.Handler, path string) (int, healthResponse) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	var response healthResponse
+	assert.NoError(tester, json.Unmarshal(recorder.Body.Bytes(), &response))
+	return recorder.Code, response
+}
+
+func TestHealthReady(tester *testing.T) {
+	logzioServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("{\"responses\":[{\"hits\":{\"total\":0,\"hits\":[]}}]}"))
+	}))
+	defer logzioServer.Close()
+	config := LogzioConfig{
+		AccountToken:      testAccountToken,
+		APIToken:          testAPIToken,
+		CustomAPIURL:      logzioServer.URL,
+		CustomListenerURL: logzioServer.URL,
+		InMemoryQueue:     true,
+	}
+	logzioStore, err := NewLogzioStore(config, logger)
+	assert.NoError(tester, err)
+	defer logzioStore.Close()
+	handler := NewHealthHandler(config, logzioStore, logger)
+
+	statusCode, response := getHealthResponse(tester, handler, healthPath)
+	assert.Equal(tester, http.StatusOK, statusCode)
+	assert.Equal(tester, healthStatusOK, response.Status)
+
+	statusCode, response = getHealthResponse(tester, handler, readyPath)
+	assert.Equal(tester, http.StatusOK, statusCode)
+	assert.Equal(tester, healthStatusOK, response.Status)
+	assert.Equal(tester, healthStatusOK, response.Checks[configCheck].Status)
+	assert.Equal(tester, healthStatusOK, response.Checks[searchAPICheck].Status)
+	assert.Equal(tester, healthStatusOK, response.Checks[listenerCheck].Status)
+	assert.Equal(tester, healthStatusSkipped, response.Checks[diskQueueCheck].Status)
+}
+
+func TestHealthNotReady(tester *testing.T) {
+	unauthorizedServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusUnauthorized)
+	}))
+	closedServer := httptest.NewServer(http.NotFoundHandler())
+	closedServer.Close()
+	defer unauthorizedServer.Close()
+	config := LogzioConfig{
+		AccountToken:      testAccountToken,
+		APIToken:          "invalidToken",
+		CustomAPIURL:      unauthorizedServer.URL,
+		CustomListenerURL: closedServer.URL,
+	}
+	logzioStore, err := NewLogzioStore(config, logger)
+	assert.NoError(tester, err)
+	defer logzioStore.Close()
+	handler := NewHealthHandler(config, logzioStore, logger)
+
+	statusCode, response := getHealthResponse(tester, handler, readyPath)
+	assert.Equal(tester, http.StatusServiceUnavailable, statusCode)
+	assert.Equal(tester, healthStatusError, response.Status)
+	assert.Equal(tester, healthStatusOK, response.Checks[configCheck].Status)
+	assert.Equal(tester, healthStatusError, response.Checks[searchAPICheck].Status)
+	assert.Contains(tester, response.Checks[searchAPICheck].Message, ErrUnauthorized.Error())
+	assert.Equal(tester, healthStatusError, response.Checks[listenerCheck].Status)
+	assert.Equal(tester, healthStatusOK, response.Checks[diskQueueCheck].Status)
+
+	_, response = getHealthResponse(tester, NewHealthHandler(LogzioConfig{}, nil, logger), readyPath)
+	assert.Equal(tester, healthStatusError, response.Checks[configCheck].Status)
+	assert.Equal(tester, healthStatusSkipped, response.Checks[searchAPICheck].Status)
+}
@@ -0,0 +1,124 @@
+package store
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "jaeger_logzio"
+	metricsPath      = "/metrics"
+)
+
+var (
+	// metricsRegistry holds the metrics of the plugin process, it's shared by all the readers and writers
+	metricsRegistry = prometheus.NewRegistry()
+	metricsFactory  = promauto.With(metricsRegistry)
+
+	spansWrittenTotal = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "spans_written_total",
+		Help:      "Number of spans queued for shipping to logz.io, by document type",
+	}, []string{"type"})
+	servicesWrittenTotal = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "service_documents_written_total",
+		Help:      "Number of service documents queued for shipping to logz.io",
+	})
+	writeErrorsTotal = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "write_errors_total",
+		Help:      "Number of spans which failed to be written",
+	})
+	spansFilteredTotal = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "spans_filtered_total",
+		Help:      "Number of spans dropped by the filter rules, by rule",
+	}, []string{"rule"})
+	senderDroppedTotal = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sender_dropped_documents_total",
+		Help:      "Number of documents dropped because the disk of the logz.io sender queue is full",
+	})
+	senderQueueBytes = metricsFactory.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "sender_queue_bytes",
+		Help:      "Size on disk of the logz.io sender queues, in memory queues are not measured",
+	}, senderQueueDirs.size)
+	searchRequestDuration = metricsFactory.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "search_request_duration_seconds",
+		Help:      "Latency of the _msearch requests to the logz.io search api",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	})
+	searchRetriesTotal = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "search_retries_total",
+		Help:      "Number of retried requests to the logz.io search api",
+	})
+	traceBulksTotal = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "trace_bulks_total",
+		Help:      "Number of trace bulks fetched by the trace finder",
+	})
+	tracesRequestedTotal = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "traces_requested_total",
+		Help:      "Number of traces requested from the trace finder",
+	})
+	tracesReturnedTotal = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "traces_returned_total",
+		Help:      "Number of traces returned by the trace finder",
+	})
+	spansUnroutedTotal = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "spans_unrouted_total",
+		Help:      "Number of spans dropped because they match no known tenant and there's no default account",
+	})
+	spansTruncatedTotal = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "spans_truncated_total",
+		Help:      "Number of spans truncated by the span size limits",
+	})
+	tailSamplingTracesTotal = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tail_sampling_traces_total",
+		Help:      "Number of traces decided by tail sampling, by decision",
+	}, []string{"decision"})
+	tailSamplingEvictedTracesTotal = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tail_sampling_evicted_traces_total",
+		Help:      "Number of traces decided before their decision wait because the tail sampling buffer was full",
+	})
+	tailSamplingLateSpansTotal = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tail_sampling_late_spans_total",
+		Help:      "Number of spans which arrived after their trace was decided by tail sampling",
+	})
+	tailSamplingBufferedTraces = metricsFactory.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "tail_sampling_buffered_traces",
+		Help:      "Number of traces buffered by tail sampling until their decision",
+	})
+)
+
+// MetricsHandler returns an http handler which exposes the plugin metrics in prometheus format
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// ServeMetrics exposes the plugin metrics on the /metrics path of address, it blocks until the listener fails
+func ServeMetrics(address string, logger hclog.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, MetricsHandler())
+	logger.Info(fmt.Sprintf("serving metrics on %s%s", address, metricsPath))
+	if err := http.ListenAndServe(address, mux); err != nil {
+		logger.Error(fmt.Sprintf("metrics listener failed: %s", err.Error()))
+	}
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSenderQueueMetrics(tester *testing.T) {
+	queueDir, err := ioutil.TempDir("", "logzio-queue")
+	assert.NoError(tester, err)
+	defer os.RemoveAll(queueDir)
+	assert.NoError(tester, ioutil.WriteFile(filepath.Join(queueDir, "000001.log"), make([]byte, 100), 0600))
+	queueBytes := testutil.ToFloat64(senderQueueBytes)
+
+	senderQueueDirs.add(queueDir)
+	senderQueueDirs.add(queueDir)
+	assert.Equal(tester, queueBytes+100, testutil.ToFloat64(senderQueueBytes), "a queue shared by two senders should be measured once")
+	senderQueueDirs.remove(queueDir)
+	assert.Equal(tester, queueBytes+100, testutil.ToFloat64(senderQueueBytes))
+	senderQueueDirs.remove(queueDir)
+	assert.Equal(tester, queueBytes, testutil.ToFloat64(senderQueueBytes))
+}
+
+func TestWriteSpanMetrics(tester *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	writer, err := NewLogzioSpanWriter(LogzioConfig{AccountToken: testAccountToken, CustomListenerURL: server.URL, InMemoryQueue: true, InMemoryCapacity: defaultInMemoryCapacity}, logger)
+	assert.NoError(tester, err)
+	defer writer.Close()
+
+	spansWritten := testutil.ToFloat64(spansWrittenTotal.WithLabelValues(spanDocumentType))
+	servicesWritten := testutil.ToFloat64(servicesWrittenTotal)
+	span := &model.Span{
+		TraceID:       model.NewTraceID(0, 1),
+		SpanID:        model.NewSpanID(1),
+		OperationName: testOperation,
+		Process:       model.NewProcess("metricsService", nil),
+		StartTime:     time.Now(),
+	}
+	assert.NoError(tester, writer.WriteSpan(context.Background(), span))
+	assert.NoError(tester, writer.WriteSpan(context.Background(), span))
+
+	assert.Equal(tester, spansWritten+2, testutil.ToFloat64(spansWrittenTotal.WithLabelValues(spanDocumentType)))
+	assert.Equal(tester, servicesWritten+1, testutil.ToFloat64(servicesWrittenTotal), "cached services are not written again")
+}
+
+func TestMetricsHandler(tester *testing.T) {
+	tracesRequestedTotal.Add(0)
+	metricsServer := httptest.NewServer(MetricsHandler())
+	defer metricsServer.Close()
+
+	resp, err := http.Get(metricsServer.URL)
+	assert.NoError(tester, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.True(tester, strings.Contains(string(body), "jaeger_logzio_traces_requested_total"))
+	assert.True(tester, strings.Contains(string(body), "jaeger_logzio_search_request_duration_seconds"))
+}
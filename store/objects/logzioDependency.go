@@ -0,0 +1,35 @@
+package objects
+
+import (
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+const dependencyLogType = "jaegerDependency"
+
+//LogzioDependency type, holds the calls between two services during a single time interval
+type LogzioDependency struct {
+	ParentService string `json:"parentService"`
+	ChildService  string `json:"childService"`
+	CallCount     uint64 `json:"callCount"`
+	ErrorCount    uint64 `json:"errorCount"`
+	StartTime     uint64 `json:"startTime"`
+	Timestamp     uint64 `json:"@timestamp"`
+	Interval      uint64 `json:"intervalSeconds"`
+	Type          string `json:"type"`
+}
+
+//NewLogzioDependency creates a new logzio dependency for the interval starting at intervalStart
+func NewLogzioDependency(parent, child string, callCount, errorCount uint64, intervalStart time.Time, interval time.Duration) LogzioDependency {
+	return LogzioDependency{
+		ParentService: parent,
+		ChildService:  child,
+		CallCount:     callCount,
+		ErrorCount:    errorCount,
+		StartTime:     model.TimeAsEpochMicroseconds(intervalStart),
+		Timestamp:     model.TimeAsEpochMicroseconds(intervalStart) / 1000,
+		Interval:      uint64(interval.Seconds()),
+		Type:          dependencyLogType,
+	}
+}
@@ -2,6 +2,7 @@ package objects
 
 import (
 	"encoding/json"
+	"strings"
 
 	"github.com/jaegertracing/jaeger/model"
 	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
@@ -9,6 +10,7 @@ import (
 
 const (
 	spanLogType                = "jaegerSpan"
+	archiveSpanLogType         = "jaegerArchiveSpan"
 	//TagDotReplacementCharacter state which character should replace the dot in es
 	TagDotReplacementCharacter = "@"
 )
@@ -31,19 +33,55 @@ type LogzioSpan struct {
 	Type            string                 `json:"type"`
 }
 
-func getTagsValues(tags []model.KeyValue) []string {
-	var values []string
-	for i := range tags {
-		values = append(values, tags[i].VStr)
+// TagLayout decides which span and process tags are stored as typed fields of the JaegerTag and process.tag objects,
+// the other tags are stored in the JaegerTags and process.tags lists with their type and a string value.
+// Binary tags are always stored in the lists
+type TagLayout struct {
+	AllTagsAsFields bool
+	TagKeysAsFields []string
+}
+
+// DefaultTagLayout stores all the tags as fields
+var DefaultTagLayout = TagLayout{AllTagsAsFields: true}
+
+// floatTagValue keeps the decimal point of whole float tag values, so they are read back as floats and not as integers
+type floatTagValue float64
+
+// MarshalJSON marshals the value like a float64, adding .0 to whole values
+func (value floatTagValue) MarshalJSON() ([]byte, error) {
+	valueBytes, err := json.Marshal(float64(value))
+	if err != nil || strings.ContainsAny(string(valueBytes), ".eE") {
+		return valueBytes, err
 	}
-	return values
+	return append(valueBytes, '.', '0'), nil
 }
 
 // TransformToLogzioSpanBytes receives a Jaeger span, converts it to logzio span and returns it as a byte array.
 // The main differences between Jaeger span and logzio span are arrays which are represented as maps
 func TransformToLogzioSpanBytes(span *model.Span) ([]byte, error) {
-	spanConverter := dbmodel.NewFromDomain(true, getTagsValues(span.Tags), TagDotReplacementCharacter)
+	return DefaultTagLayout.TransformToLogzioSpanBytes(span)
+}
+
+// TransformToLogzioArchiveSpanBytes is the same as TransformToLogzioSpanBytes, for spans of archived traces
+func TransformToLogzioArchiveSpanBytes(span *model.Span) ([]byte, error) {
+	return DefaultTagLayout.TransformToLogzioArchiveSpanBytes(span)
+}
+
+// TransformToLogzioSpanBytes converts the span to logzio span bytes with the tags in the layout
+func (layout TagLayout) TransformToLogzioSpanBytes(span *model.Span) ([]byte, error) {
+	return json.Marshal(layout.transformToLogzioSpan(span, spanLogType))
+}
+
+// TransformToLogzioArchiveSpanBytes converts the span to logzio archive span bytes with the tags in the layout
+func (layout TagLayout) TransformToLogzioArchiveSpanBytes(span *model.Span) ([]byte, error) {
+	return json.Marshal(layout.transformToLogzioSpan(span, archiveSpanLogType))
+}
+
+func (layout TagLayout) transformToLogzioSpan(span *model.Span, logType string) LogzioSpan {
+	spanConverter := dbmodel.NewFromDomain(layout.AllTagsAsFields, layout.TagKeysAsFields, TagDotReplacementCharacter)
 	jsonSpan := spanConverter.FromDomainEmbedProcess(span)
+	keepFloatTagValues(jsonSpan.Tag)
+	keepFloatTagValues(jsonSpan.Process.Tag)
 	logzioSpan := LogzioSpan{
 		TraceID:         jsonSpan.TraceID,
 		OperationName:   jsonSpan.OperationName,
@@ -58,9 +96,17 @@ func TransformToLogzioSpanBytes(span *model.Span) ([]byte, error) {
 		Tag:             jsonSpan.Tag,
 		Process:         jsonSpan.Process,
 		Logs:            jsonSpan.Logs,
-		Type:            spanLogType,
+		Type:            logType,
+	}
+	return logzioSpan
+}
+
+func keepFloatTagValues(tags map[string]interface{}) {
+	for key, value := range tags {
+		if floatValue, ok := value.(float64); ok {
+			tags[key] = floatTagValue(floatValue)
+		}
 	}
-	return json.Marshal(logzioSpan)
 }
 
 // TransformToDbModelSpan coverts logz.io span to ElasticSearch span
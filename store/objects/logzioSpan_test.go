@@ -1,12 +1,16 @@
 package objects
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"testing"
+	"time"
 
 	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestTransformToLogzioSpanBytes(tester *testing.T) {
@@ -24,3 +28,65 @@ func TestTransformToLogzioSpanBytes(tester *testing.T) {
 		tester.Error("error converting span to logzioSpan, JaegerTag is not found")
 	}
 }
+
+func typedTagsSpan() *model.Span {
+	return &model.Span{
+		TraceID:   model.NewTraceID(0, 1),
+		SpanID:    model.NewSpanID(1),
+		StartTime: time.Unix(0, 0),
+		Tags: []model.KeyValue{
+			model.String("http.method", "GET"),
+			model.Int64("http.status_code", 200),
+			model.Float64("ratio", 2),
+			model.Float64("latency", 0.25),
+			model.Bool("error", true),
+			model.Binary("payload", []byte{1, 2}),
+		},
+		Process: model.NewProcess("api", []model.KeyValue{model.Int64("pid", 42)}),
+	}
+}
+
+// readTagLayoutSpan reads a span back like the span reader does
+func readTagLayoutSpan(tester *testing.T, spanBytes []byte) *model.Span {
+	decoder := json.NewDecoder(bytes.NewReader(spanBytes))
+	decoder.UseNumber()
+	var logzioSpan LogzioSpan
+	assert.NoError(tester, decoder.Decode(&logzioSpan))
+	span, err := dbmodel.NewToDomain(TagDotReplacementCharacter).SpanToDomain(logzioSpan.TransformToDbModelSpan())
+	assert.NoError(tester, err)
+	return span
+}
+
+func TestTagLayoutsKeepTagTypes(tester *testing.T) {
+	for _, layout := range []TagLayout{DefaultTagLayout, {TagKeysAsFields: []string{"http.status_code", "ratio"}}, {}} {
+		spanBytes, err := layout.TransformToLogzioSpanBytes(typedTagsSpan())
+		assert.NoError(tester, err)
+		span := readTagLayoutSpan(tester, spanBytes)
+		assert.ElementsMatch(tester, typedTagsSpan().Tags, span.Tags, layout)
+		assert.Equal(tester, typedTagsSpan().Process.Tags, span.Process.Tags, layout)
+	}
+}
+
+func TestTagLayoutFields(tester *testing.T) {
+	var document map[string]interface{}
+	spanBytes, err := DefaultTagLayout.TransformToLogzioSpanBytes(typedTagsSpan())
+	assert.NoError(tester, err)
+	assert.Contains(tester, string(spanBytes), `"ratio":2.0`)
+	assert.NoError(tester, json.Unmarshal(spanBytes, &document))
+	assert.Len(tester, document["JaegerTag"], 5)
+	assert.Len(tester, document["JaegerTags"], 1)
+
+	spanBytes, err = TagLayout{TagKeysAsFields: []string{"http.status_code"}}.TransformToLogzioSpanBytes(typedTagsSpan())
+	assert.NoError(tester, err)
+	document = nil
+	assert.NoError(tester, json.Unmarshal(spanBytes, &document))
+	assert.Equal(tester, map[string]interface{}{"http@status_code": float64(200)}, document["JaegerTag"])
+	assert.Len(tester, document["JaegerTags"], 5)
+
+	spanBytes, err = TagLayout{}.TransformToLogzioSpanBytes(typedTagsSpan())
+	assert.NoError(tester, err)
+	document = nil
+	assert.NoError(tester, json.Unmarshal(spanBytes, &document))
+	assert.Nil(tester, document["JaegerTag"])
+	assert.Len(tester, document["JaegerTags"], 6)
+}
@@ -14,6 +14,28 @@ import (
 	"github.com/pkg/errors"
 )
 
+// timeWindow is a time range of a single search request
+type timeWindow struct {
+	startTime time.Time
+	endTime   time.Time
+}
+
+// splitTimeWindow splits a time range to consecutive windows no longer than maxWindow, newest window first
+func splitTimeWindow(startTime time.Time, endTime time.Time, maxWindow time.Duration) []timeWindow {
+	var windows []timeWindow
+	for windowEnd := endTime; windowEnd.After(startTime); windowEnd = windowEnd.Add(-maxWindow) {
+		windowStart := windowEnd.Add(-maxWindow)
+		if windowStart.Before(startTime) {
+			windowStart = startTime
+		}
+		windows = append(windows, timeWindow{startTime: windowStart, endTime: windowEnd})
+	}
+	if len(windows) == 0 {
+		windows = append(windows, timeWindow{startTime: startTime, endTime: endTime})
+	}
+	return windows
+}
+
 func convertTraceIDsStringsToModels(traceIDs []string) ([]model.TraceID, error) {
 	traceIDsModels := make([]model.TraceID, len(traceIDs))
 	for i, ID := range traceIDs {
@@ -85,6 +107,16 @@ func buildNestedQuery(field string, k string, v string) elastic.Query {
 	return elastic.NewNestedQuery(field, tagBoolQuery)
 }
 
+// buildListQuery matches tags of the key value lists, the lists aren't mapped as nested
+// so the key and the value may match different tags of the same span
+func buildListQuery(field string, k string, v string) elastic.Query {
+	keyField := fmt.Sprintf("%s.%s", field, tagKeyField)
+	valueField := fmt.Sprintf("%s.%s", field, tagValueField)
+	keyQuery := elastic.NewTermQuery(keyField, k)
+	valueQuery := elastic.NewMatchQuery(valueField, v)
+	return elastic.NewBoolQuery().Must(keyQuery, valueQuery)
+}
+
 func buildObjectQuery(field string, k string, v string) elastic.Query {
 	keyField := fmt.Sprintf("%s.%s", field, k)
 	keyQuery := elastic.NewMatchQuery(keyField, v)
@@ -107,9 +139,6 @@ func validateQuery(p *spanstore.TraceQueryParameters) error {
 	if p == nil {
 		return ErrMalformedRequestObject
 	}
-	if p.ServiceName == "" && len(p.Tags) > 0 {
-		return ErrServiceNameNotSet
-	}
 	if p.StartTimeMin.IsZero() || p.StartTimeMax.IsZero() {
 		return ErrStartAndEndTimeNotSet
 	}
@@ -119,6 +148,11 @@ func validateQuery(p *spanstore.TraceQueryParameters) error {
 	if p.DurationMin != 0 && p.DurationMax != 0 && p.DurationMin > p.DurationMax {
 		return ErrDurationMinGreaterThanMax
 	}
+	for k, v := range p.Tags {
+		if _, err := parseTagQuery(k, v); err != nil {
+			return err
+		}
+	}
 	if p.NumTraces > 1000 {
 		p.NumTraces = 1000
 	}
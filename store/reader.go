@@ -16,7 +16,9 @@ import (
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/pkg/cache"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -31,18 +33,25 @@ const (
 	operationNameField     = "operationName"
 	objectTagsField        = "JaegerTag"
 	objectProcessTagsField = "process.tag"
+	listTagsField          = "JaegerTags"
+	listProcessTagsField   = "process.tags"
+	logFieldsField         = "logs.fields"
 	tagKeyField            = "key"
 	tagValueField          = "value"
 
 	defaultDocCount          = 10000 // the default elasticsearch allowed limit
 	logzioMaxAggregationSize = 1000
 	defaultNumTraces         = 100
-	maxSearchWindowHours     = 48
+	apiSearchWindowHours     = 48 // the longest time range logz.io api accepts in a single search
 	singleValueIndex         = 0
+	traceStartCacheSize      = 10000
+	traceStartMargin         = time.Hour // spans may start before the cached trace start due to clock skew
 )
 
 var (
-	// ErrServiceNameNotSet occurs when attempting to query with an empty service name
+	// ErrServiceNameNotSet occurred when attempting to query with an empty service name.
+	//
+	// Deprecated: searches without a service are supported and the reader no longer returns this error
 	ErrServiceNameNotSet = errors.New("Service Name must be set")
 
 	// ErrStartTimeMinGreaterThanMax occurs when start time min is above start time max
@@ -60,28 +69,59 @@ var (
 	// ErrUnableToFindTraceIDAggregation occurs when an aggregation query for TraceIDs fail.
 	ErrUnableToFindTraceIDAggregation = errors.New("Could not find aggregation of traceIDs")
 
+	// ErrQueryDeadlineExceeded occurs when a trace was not retrieved before the query timeout
+	ErrQueryDeadlineExceeded = errors.New("Query timeout exceeded before the trace was retrieved")
+
 	defaultMaxDuration = model.DurationAsMicroseconds(time.Hour * 24)
 
 	objectTagFieldList = []string{objectTagsField, objectProcessTagsField}
+	listTagFieldList   = []string{listTagsField, listProcessTagsField}
 )
 
 // LogzioSpanReader is a struct which holds logzio span reader properties
 type LogzioSpanReader struct {
 	apiToken                string
 	apiURL                  string
+	spanType                string
+	archive                 bool
+	maxSearchWindow         time.Duration
+	traceLookupWindow       time.Duration
+	traceStartCache         cache.Cache
+	rateLimiter             *rate.Limiter
 	logger                  hclog.Logger
 	sourceFn                sourceFn
 	client                  *http.Client
 	traceFinder             TraceFinder
+	dependencyFinder        *DependencyFinder
 	serviceOperationStorage *ServiceOperationStorage
+	// searchFields are added to the filters of all the searches, to scope the reader to the documents with these fields
+	searchFields []elastic.Query
+	// tagSearchWindow limits the searches without a service, tagSearchNumTraces is their default number of traces
+	tagSearchWindow    time.Duration
+	tagSearchNumTraces int
 }
 
 // NewLogzioSpanReader creates a new logzio span reader
 func NewLogzioSpanReader(config LogzioConfig, logger hclog.Logger) *LogzioSpanReader {
+	return newLogzioSpanReader(config, config.APIToken, spanDocumentType, false, logger)
+}
+
+func newLogzioSpanReader(config LogzioConfig, apiToken string, spanType string, archive bool, logger hclog.Logger) *LogzioSpanReader {
 	reader := &LogzioSpanReader{
-		logger:   logger,
-		apiToken: config.APIToken,
-		apiURL:   config.APIURL(),
+		logger:            logger,
+		apiToken:          apiToken,
+		apiURL:            config.APIURL(),
+		spanType:          spanType,
+		archive:           archive,
+		maxSearchWindow:   config.maxSearchWindow(),
+		traceLookupWindow: config.traceLookupWindow(),
+		rateLimiter:       sharedRateLimiter(apiToken, config.apiRequestsPerSecond()),
+		traceStartCache: cache.NewLRUWithOptions(
+			traceStartCacheSize,
+			&cache.Options{
+				TTL: 24 * time.Hour,
+			},
+		),
 		sourceFn: getSourceFn(),
 		client: &http.Client{
 			Transport: &http.Transport{
@@ -89,8 +129,24 @@ func NewLogzioSpanReader(config LogzioConfig, logger hclog.Logger) *LogzioSpanRe
 			},
 		},
 	}
+	if archive {
+		// archived traces are kept for as long as the archive account retention, not only the spans retention
+		reader.traceLookupWindow = config.archiveLookupWindow()
+	}
+	// archived traces are looked up by their trace ids, so archive searches aren't scoped
+	if !archive {
+		searchFields, err := newExtraFields(config.SearchFields)
+		if err != nil {
+			logger.Error(fmt.Sprintf("ignoring invalid search fields: %s", err.Error()))
+		} else {
+			reader.searchFields = searchFields.queries()
+		}
+	}
+	reader.tagSearchWindow = config.tagSearchWindow()
+	reader.tagSearchNumTraces = config.tagSearchNumTraces()
 	reader.serviceOperationStorage = NewServiceOperationStorage(reader)
-	reader.traceFinder = NewTraceFinder(reader)
+	reader.traceFinder = NewTraceFinder(reader, config)
+	reader.dependencyFinder = NewDependencyFinder(reader)
 	return reader
 }
 
@@ -108,20 +164,78 @@ func getSourceFn() sourceFn {
 	}
 }
 
-// GetTrace returns a Jaeger trace by traceID
+// GetTrace returns a Jaeger trace by traceID.
+// The trace is looked up in the most recent window first, then in older windows up to the configured retention.
+// The start time of a found trace is cached, so opening it again searches the right window first
 func (reader *LogzioSpanReader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "GetTrace")
 	defer span.Finish()
-	currentTime := time.Now()
-	traces, err := reader.traceFinder.multiRead([]model.TraceID{traceID}, currentTime.Add(-time.Hour*maxSearchWindowHours), currentTime)
+	cachedWindow, isCached := reader.cachedTraceWindow(traceID)
+	if isCached {
+		trace, err := reader.getTraceInWindow(ctx, traceID, cachedWindow)
+		if err != spanstore.ErrTraceNotFound {
+			return trace, err
+		}
+		reader.traceStartCache.Delete(traceID.String())
+	}
+	for _, window := range reader.traceLookupWindows() {
+		trace, err := reader.getTraceInWindow(ctx, traceID, window)
+		if err == spanstore.ErrTraceNotFound {
+			continue
+		}
+		if err == nil {
+			reader.cacheTraceStart(traceID, trace)
+		}
+		return trace, err
+	}
+	return nil, spanstore.ErrTraceNotFound
+}
+
+// getTraceInWindow returns spanstore.ErrTraceNotFound if the trace has no spans in the window,
+// or the reason the trace could not be retrieved
+func (reader *LogzioSpanReader) getTraceInWindow(ctx context.Context, traceID model.TraceID, window timeWindow) (*model.Trace, error) {
+	result, err := reader.traceFinder.multiRead(ctx, []model.TraceID{traceID}, window.startTime, window.endTime)
 	if err != nil {
 		return nil, err
 	}
-	if len(traces) == 0 {
-		return nil, spanstore.ErrTraceNotFound
+	if len(result.traces) > 0 {
+		//here we are using multiread to get a single trace. since multiread returns an array of result, we only want the first (and only) result
+		return result.traces[singleValueIndex], nil
+	}
+	if reason, ok := result.missing[traceID]; ok {
+		return nil, reason
+	}
+	return nil, spanstore.ErrTraceNotFound
+}
+
+func (reader *LogzioSpanReader) traceLookupWindows() []timeWindow {
+	currentTime := time.Now()
+	return splitTimeWindow(currentTime.Add(-reader.traceLookupWindow), currentTime, time.Hour*apiSearchWindowHours)
+}
+
+func (reader *LogzioSpanReader) cachedTraceWindow(traceID model.TraceID) (timeWindow, bool) {
+	traceStart, ok := reader.traceStartCache.Get(traceID.String()).(time.Time)
+	if !ok {
+		return timeWindow{}, false
+	}
+	window := timeWindow{startTime: traceStart.Add(-traceStartMargin)}
+	window.endTime = window.startTime.Add(time.Hour * apiSearchWindowHours)
+	if currentTime := time.Now(); window.endTime.After(currentTime) {
+		window.endTime = currentTime
+	}
+	return window, true
+}
+
+func (reader *LogzioSpanReader) cacheTraceStart(traceID model.TraceID, trace *model.Trace) {
+	var traceStart time.Time
+	for _, span := range trace.Spans {
+		if traceStart.IsZero() || span.StartTime.Before(traceStart) {
+			traceStart = span.StartTime
+		}
+	}
+	if !traceStart.IsZero() {
+		reader.traceStartCache.Put(traceID.String(), traceStart)
 	}
-	//here we are using multiread to get a single trace. since multiread returns an array of result, we only want the first (and only) result
-	return traces[singleValueIndex], nil
 }
 
 // GetServices returns an array of all the service names that are being monitored
@@ -132,7 +246,7 @@ func (reader *LogzioSpanReader) GetServices(ctx context.Context) ([]string, erro
 }
 
 // GetOperations returns an array of all the operations a specific service performed
-func  (reader *LogzioSpanReader) GetOperations(ctx context.Context, query spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
+func (reader *LogzioSpanReader) GetOperations(ctx context.Context, query spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "GetOperations")
 	defer span.Finish()
 	operations, err := reader.serviceOperationStorage.getOperations(ctx, query.ServiceName)
@@ -148,7 +262,6 @@ func  (reader *LogzioSpanReader) GetOperations(ctx context.Context, query spanst
 	}
 	return result, err
 
-
 }
 
 // FindTraces return an array of Jaeger traces by a search query
@@ -156,15 +269,23 @@ func (reader *LogzioSpanReader) FindTraces(ctx context.Context, query *spanstore
 	span, ctx := opentracing.StartSpanFromContext(ctx, "FindTraces")
 	defer span.Finish()
 
-	spansMaxMinTimeDifferenceHours := query.StartTimeMax.Sub(query.StartTimeMin).Hours()
-	if spansMaxMinTimeDifferenceHours > maxSearchWindowHours {
-		query.StartTimeMin = query.StartTimeMax.Add(-time.Hour * maxSearchWindowHours)
-	}
-	uniqueTraceIDs, err := reader.FindTraceIDs(ctx, query)
+	chunks, err := reader.findTraceIDsChunks(ctx, query)
 	if err != nil {
 		return nil, err
 	}
-	return reader.traceFinder.multiRead(uniqueTraceIDs, query.StartTimeMin, query.StartTimeMax)
+	var traces []*model.Trace
+	for _, chunk := range chunks {
+		result, err := reader.traceFinder.multiRead(ctx, chunk.traceIDs, chunk.window.startTime, chunk.window.endTime)
+		if err != nil {
+			return nil, err
+		}
+		if result.isPartial() {
+			reader.logger.Warn(fmt.Sprintf("retrieved %d out of %d traces", len(result.traces), len(chunk.traceIDs)))
+			result.logMissing(reader.logger)
+		}
+		traces = append(traces, result.traces...)
+	}
+	return traces, nil
 }
 
 // FindTraceIDs retrieve traceIDs that match the traceQuery
@@ -172,23 +293,80 @@ func (reader *LogzioSpanReader) FindTraceIDs(ctx context.Context, query *spansto
 	span, ctx := opentracing.StartSpanFromContext(ctx, "FindTraceIDs")
 	defer span.Finish()
 
+	chunks, err := reader.findTraceIDsChunks(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	var traceIDs []model.TraceID
+	for _, chunk := range chunks {
+		traceIDs = append(traceIDs, chunk.traceIDs...)
+	}
+	return traceIDs, nil
+}
+
+// traceIDsChunk holds the trace ids found in a single search window
+type traceIDsChunk struct {
+	window   timeWindow
+	traceIDs []model.TraceID
+}
+
+// findTraceIDsChunks searches the query time range in windows the logz.io api accepts, newest window first,
+// until the requested number of traces is found
+func (reader *LogzioSpanReader) findTraceIDsChunks(ctx context.Context, query *spanstore.TraceQueryParameters) ([]traceIDsChunk, error) {
 	if err := validateQuery(query); err != nil {
 		return nil, err
 	}
+	searchWindow := reader.maxSearchWindow
+	numTraces := defaultNumTraces
+	// searches without a service match the spans of all the services, so they are kept cheaper
+	if query.ServiceName == "" {
+		searchWindow = reader.tagSearchWindow
+		numTraces = reader.tagSearchNumTraces
+	}
 	if query.NumTraces == 0 {
-		query.NumTraces = defaultNumTraces
+		query.NumTraces = numTraces
 	}
-	esTraceIDs, err := reader.traceFinder.findTraceIDsStrings(ctx, query)
-	if err != nil {
-		return nil, err
+	if query.StartTimeMax.Sub(query.StartTimeMin) > searchWindow {
+		query.StartTimeMin = query.StartTimeMax.Add(-searchWindow)
+	}
+
+	var chunks []traceIDsChunk
+	foundTraceIDs := make(map[string]bool)
+	for _, window := range splitTimeWindow(query.StartTimeMin, query.StartTimeMax, time.Hour*apiSearchWindowHours) {
+		windowQuery := *query
+		windowQuery.StartTimeMin = window.startTime
+		windowQuery.StartTimeMax = window.endTime
+		windowQuery.NumTraces = query.NumTraces - len(foundTraceIDs)
+		esTraceIDs, err := reader.traceFinder.findTraceIDsStrings(ctx, &windowQuery)
+		if err != nil {
+			return nil, err
+		}
+		var newTraceIDs []string
+		for _, traceID := range esTraceIDs {
+			// windows share their edges, a trace may be found in two consecutive windows
+			if !foundTraceIDs[traceID] {
+				foundTraceIDs[traceID] = true
+				newTraceIDs = append(newTraceIDs, traceID)
+			}
+		}
+		reader.logger.Debug(fmt.Sprintf("found traceIDs: %v", newTraceIDs))
+		traceIDs, err := convertTraceIDsStringsToModels(newTraceIDs)
+		if err != nil {
+			return nil, err
+		}
+		if len(traceIDs) > 0 {
+			chunks = append(chunks, traceIDsChunk{window: window, traceIDs: traceIDs})
+		}
+		if len(foundTraceIDs) >= query.NumTraces {
+			break
+		}
 	}
-	reader.logger.Debug(fmt.Sprintf("found traceIDs: %v", esTraceIDs))
-	return convertTraceIDsStringsToModels(esTraceIDs)
+	return chunks, nil
 }
 
-func (reader *LogzioSpanReader) getHTTPRequest(requestBody string) (*http.Request, error) {
+func (reader *LogzioSpanReader) getHTTPRequest(ctx context.Context, requestBody string) (*http.Request, error) {
 	reader.logger.Debug("creating multisearch request: %s", requestBody)
-	req, err := http.NewRequest(httpPost, reader.apiURL, strings.NewReader(requestBody))
+	req, err := http.NewRequestWithContext(ctx, httpPost, reader.apiURL, strings.NewReader(requestBody))
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create multiSearch request")
 	}
@@ -196,30 +374,41 @@ func (reader *LogzioSpanReader) getHTTPRequest(requestBody string) (*http.Reques
 	return req, nil
 }
 
-func (reader *LogzioSpanReader) getHTTPResponseBytes(request *http.Request) ([]byte, error) {
+func (reader *LogzioSpanReader) getHTTPResponseBytes(request *http.Request) (responseBytes []byte, err error) {
+	span, _ := startSpan(request.Context(), "logzioSearchRequest")
+	defer func() { finishSpan(span, err) }()
+	requestStart := time.Now()
 	resp, err := reader.client.Do(request)
+	searchRequestDuration.Observe(time.Since(requestStart).Seconds())
 	if err != nil {
-		return nil, errors.Wrap(err, "failed perform multiSearch request")
+		if request.Context().Err() != nil {
+			return nil, request.Context().Err()
+		}
+		return nil, newRetryableError(errors.Wrap(err, "failed perform multiSearch request"))
 	}
 
-	responseBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, errors.Wrap(err, "can't read response body")
-	}
-	if err = resp.Body.Close(); err != nil {
+	span.SetTag("http.status_code", resp.StatusCode)
+	responseBytes, err = ioutil.ReadAll(resp.Body)
+	if closeErr := resp.Body.Close(); closeErr != nil {
 		reader.logger.Warn("can't close response body, possible memory leak")
 	}
+	if err != nil {
+		return nil, newRetryableError(errors.Wrap(err, "can't read response body"))
+	}
 	reader.logger.Trace(fmt.Sprintf("got response from logz.io: %s", string(responseBytes)))
 
+	if err = checkResponseStatus(resp, responseBytes); err != nil {
+		return nil, err
+	}
 	if err = checkErrorResponse(responseBytes); err != nil {
 		return nil, err
 	}
 	return responseBytes, nil
 }
 
-//this is kink of a hack function, we use multisearch to perform a single search
-func (reader *LogzioSpanReader) getSearchResult(requestBody string) (*elastic.SearchResult, error) {
-	multiSearchResult, err := reader.getMultiSearchResult(requestBody)
+// this is kink of a hack function, we use multisearch to perform a single search
+func (reader *LogzioSpanReader) getSearchResult(ctx context.Context, requestBody string) (*elastic.SearchResult, error) {
+	multiSearchResult, err := reader.getMultiSearchResult(ctx, requestBody)
 	if err != nil {
 		return nil, err
 	}
@@ -230,37 +419,38 @@ func (reader *LogzioSpanReader) getSearchResult(requestBody string) (*elastic.Se
 	return nil, nil
 }
 
-func (reader *LogzioSpanReader) getMultiSearchResult(requestBody string) (elastic.MultiSearchResult, error) {
+func (reader *LogzioSpanReader) getMultiSearchResult(ctx context.Context, requestBody string) (elastic.MultiSearchResult, error) {
 	if reader.apiToken == "" {
-		return elastic.MultiSearchResult{}, errors.New("empty API token, can't perform search")
+		return elastic.MultiSearchResult{}, &SearchError{Kind: ErrUnauthorized, Message: "empty API token, can't perform search"}
 	}
-	req, err := reader.getHTTPRequest(requestBody)
-	if err != nil {
-		return elastic.MultiSearchResult{}, err
-	}
-	responseBytes, err := reader.getHTTPResponseBytes(req)
+	var multiSearchResult elastic.MultiSearchResult
+	err := searchWithRetry(ctx, reader.rateLimiter, reader.logger, func() error {
+		req, err := reader.getHTTPRequest(ctx, requestBody)
+		if err != nil {
+			return err
+		}
+		responseBytes, err := reader.getHTTPResponseBytes(req)
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(responseBytes, &multiSearchResult); err != nil {
+			return newMalformedResponseError(errors.Wrap(err, "failed to parse http response"))
+		}
+		return nil
+	})
 	if err != nil {
 		return elastic.MultiSearchResult{}, err
 	}
-
-	var multiSearchResult elastic.MultiSearchResult
-	if err = json.Unmarshal(responseBytes, &multiSearchResult); err != nil {
-		return elastic.MultiSearchResult{}, errors.Wrap(err, "failed to parse http response")
-	}
-	return multiSearchResult, err
+	return multiSearchResult, nil
 }
 
 // GetDependencies returns an array of all the dependencies in a specific time range
-func (*LogzioSpanReader) GetDependencies(ctx context.Context, endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
-	return nil, nil
-}
+func (reader *LogzioSpanReader) GetDependencies(ctx context.Context, endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "GetDependencies")
+	defer span.Finish()
 
-func checkErrorResponse(response []byte) error {
-	var respMap map[string]interface{}
-	_ = json.Unmarshal(response, &respMap)
-	_, exist := respMap["errorCode"]
-	if exist {
-		return errors.New(fmt.Sprintf("got error response: %s", string(response)))
+	if lookback > reader.maxSearchWindow {
+		lookback = reader.maxSearchWindow
 	}
-	return nil
+	return reader.dependencyFinder.getDependencies(ctx, endTs.Add(-lookback), endTs)
 }
@@ -8,7 +8,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -56,6 +59,37 @@ func checkRecordedRequestAndGetBody(tester *testing.T, requestCount int) string
 	return fullBody
 }
 
+// recordedSearches holds the bodies of the search requests a recording server got
+type recordedSearches struct {
+	lock     sync.Mutex
+	requests []string
+}
+
+func (recorded *recordedSearches) get() []string {
+	recorded.lock.Lock()
+	defer recorded.lock.Unlock()
+	return append([]string(nil), recorded.requests...)
+}
+
+func (recorded *recordedSearches) reset() {
+	recorded.lock.Lock()
+	defer recorded.lock.Unlock()
+	recorded.requests = nil
+}
+
+// newRecordingServer returns a search server which records the request bodies and answers them all with the response
+func newRecordingServer(response []byte) (*httptest.Server, *recordedSearches) {
+	recorded := &recordedSearches{}
+	recordingServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		recorded.lock.Lock()
+		recorded.requests = append(recorded.requests, string(body))
+		recorded.lock.Unlock()
+		_, _ = rw.Write(response)
+	}))
+	return recordingServer, recorded
+}
+
 func TestGetTrace(tester *testing.T) {
 	_, _ = reader.GetTrace(context.Background(), model.TraceID{Low: 1, High: 0})
 	reqBody := checkRecordedRequestAndGetBody(tester, 1)
@@ -143,3 +177,197 @@ func TestFindTraceIDs(tester *testing.T) {
 			fmt.Sprintf("tag filter for '%s' is incorrect or not exist", key))
 	}
 }
+
+func TestGetDependencies(tester *testing.T) {
+	var dependenciesRequest []byte
+	dependenciesServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		dependenciesRequest, _ = ioutil.ReadAll(req.Body)
+		resp, _ := ioutil.ReadFile("fixtures/dependencies_response.json")
+		_, _ = rw.Write(resp)
+	}))
+	defer dependenciesServer.Close()
+	dependenciesReader := NewLogzioSpanReader(LogzioConfig{APIToken: testAPIToken, CustomAPIURL: dependenciesServer.URL}, logger)
+
+	links, err := dependenciesReader.GetDependencies(context.Background(), time.Now(), time.Hour)
+	assert.NoError(tester, err)
+	assert.True(tester, strings.Contains(string(dependenciesRequest), "{\"term\":{\"type\":\"jaegerSpan\"}}"), "span type filter is incorrect or not exist")
+	assert.Equal(tester, []model.DependencyLink{
+		{Parent: "driver", Child: "redis", CallCount: 2},
+		{Parent: "frontend", Child: "driver", CallCount: 1},
+	}, links)
+}
+
+func TestGetPrecomputedDependencies(tester *testing.T) {
+	requestCount := 0
+	dependenciesServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requestCount++
+		resp, _ := ioutil.ReadFile("fixtures/dependency_aggregation_response.json")
+		_, _ = rw.Write(resp)
+	}))
+	defer dependenciesServer.Close()
+	dependenciesReader := NewLogzioSpanReader(LogzioConfig{APIToken: testAPIToken, CustomAPIURL: dependenciesServer.URL}, logger)
+
+	links, err := dependenciesReader.GetDependencies(context.Background(), time.Now(), time.Hour)
+	assert.NoError(tester, err)
+	assert.Equal(tester, 1, requestCount, "raw spans should not be searched when precomputed dependencies exist")
+	assert.Equal(tester, []model.DependencyLink{
+		{Parent: "driver", Child: "redis", CallCount: 3},
+		{Parent: "frontend", Child: "driver", CallCount: 7},
+	}, links)
+}
+
+func TestGetArchiveTrace(tester *testing.T) {
+	archiveReader := NewLogzioArchiveSpanReader(LogzioConfig{APIToken: testAPIToken, CustomAPIURL: server.URL}, logger)
+	_, _ = archiveReader.GetTrace(context.Background(), model.TraceID{Low: 1, High: 0})
+	reqBody := checkRecordedRequestAndGetBody(tester, 1)
+	assert.True(tester, strings.Contains(reqBody, "{\"term\":{\"type\":\"jaegerArchiveSpan\"}}"), "archive span type filter is incorrect or not exist")
+	assert.False(tester, strings.Contains(reqBody, "{\"range\":{\"startTime\":{\"from\":0,"), "archive search should be split to api sized windows")
+
+	archiveReader = NewLogzioArchiveSpanReader(LogzioConfig{APIToken: testAPIToken, CustomAPIURL: server.URL, RetentionDays: 2, ArchiveRetentionDays: 4}, logger)
+	assert.Len(tester, archiveReader.traceLookupWindows(), 2, "archived traces should be looked up back to the archive retention")
+}
+
+func TestFindTraceIDsSearchWindows(tester *testing.T) {
+	resp, _ := ioutil.ReadFile("fixtures/trace_ids_response.json")
+	windowsServer, recorded := newRecordingServer(resp)
+	defer windowsServer.Close()
+	windowsReader := NewLogzioSpanReader(LogzioConfig{APIToken: testAPIToken, CustomAPIURL: windowsServer.URL, MaxSearchWindowHours: 96}, logger)
+
+	maxTime := time.Unix(1000000, 0)
+	query := spanstore.TraceQueryParameters{
+		ServiceName:  testService,
+		StartTimeMin: maxTime.Add(-time.Hour * 200),
+		StartTimeMax: maxTime,
+	}
+	traceIDs, err := windowsReader.FindTraceIDs(context.Background(), &query)
+	assert.NoError(tester, err)
+	searchRequests := recorded.get()
+	assert.Equal(tester, 2, len(traceIDs), "trace ids found in several windows should be returned once")
+	assert.Equal(tester, 2, len(searchRequests), "the search window should be limited to 96 hours and split to 48 hours windows")
+
+	windowMiddle := model.TimeAsEpochMicroseconds(maxTime.Add(-time.Hour * apiSearchWindowHours))
+	windowStart := model.TimeAsEpochMicroseconds(maxTime.Add(-time.Hour * 96))
+	assert.True(tester, strings.Contains(searchRequests[0],
+		fmt.Sprintf("{\"range\":{\"startTime\":{\"from\":%d,\"include_lower\":true,\"include_upper\":true,\"to\":%d}}}", windowMiddle, model.TimeAsEpochMicroseconds(maxTime))),
+		"newest window should be searched first")
+	assert.True(tester, strings.Contains(searchRequests[1],
+		fmt.Sprintf("{\"range\":{\"startTime\":{\"from\":%d,\"include_lower\":true,\"include_upper\":true,\"to\":%d}}}", windowStart, windowMiddle)),
+		"older window time range is incorrect or not exist")
+}
+
+func TestFindTraceIDsWithoutService(tester *testing.T) {
+	resp, _ := ioutil.ReadFile("fixtures/trace_ids_response.json")
+	tagsServer, recorded := newRecordingServer(resp)
+	defer tagsServer.Close()
+	tagsReader := NewLogzioSpanReader(LogzioConfig{APIToken: testAPIToken, CustomAPIURL: tagsServer.URL}, logger)
+
+	maxTime := time.Unix(1000000, 0)
+	query := spanstore.TraceQueryParameters{
+		Tags:         map[string]string{"customer.id": "123"},
+		StartTimeMin: maxTime.Add(-time.Hour * 48),
+		StartTimeMax: maxTime,
+	}
+	_, err := tagsReader.FindTraceIDs(context.Background(), &query)
+	assert.NoError(tester, err)
+	searchRequests := recorded.get()
+	assert.Equal(tester, 1, len(searchRequests), "the search window should be limited to 6 hours")
+	assert.Equal(tester, defaultTagSearchNumTraces, query.NumTraces)
+	assert.Contains(tester, searchRequests[0], fmt.Sprintf("{\"range\":{\"startTime\":{\"from\":%d,", model.TimeAsEpochMicroseconds(maxTime.Add(-time.Hour*6))))
+	assert.Contains(tester, searchRequests[0], "\"size\":20")
+	assert.NotContains(tester, searchRequests[0], serviceNameField)
+
+	recorded.reset()
+	query.NumTraces = 100
+	_, err = tagsReader.FindTraceIDs(context.Background(), &query)
+	assert.NoError(tester, err)
+	assert.Equal(tester, 100, query.NumTraces, "a limit set in the search should be kept")
+	assert.Contains(tester, recorded.get()[0], "\"size\":100")
+}
+
+func TestGetTraceLookupWindows(tester *testing.T) {
+	traceStart := time.Now().Add(-time.Hour * 100)
+	spanBytes, _ := objects.TransformToLogzioSpanBytes(&model.Span{
+		TraceID:       model.NewTraceID(0, 1),
+		SpanID:        model.NewSpanID(1),
+		OperationName: testOperation,
+		StartTime:     traceStart,
+		Process:       model.NewProcess(testService, nil),
+	})
+	rangeRegex := regexp.MustCompile(`"range":\{"startTime":\{"from":(\d+),"include_lower":true,"include_upper":true,"to":(\d+)\}`)
+	var requestedWindows []uint64
+	var lock sync.Mutex
+	lookupServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		timeRange := rangeRegex.FindStringSubmatch(string(body))
+		from, _ := strconv.ParseUint(timeRange[1], 10, 64)
+		lock.Lock()
+		requestedWindows = append(requestedWindows, from)
+		lock.Unlock()
+		to, _ := strconv.ParseUint(timeRange[2], 10, 64)
+		hits := ""
+		if spanTime := model.TimeAsEpochMicroseconds(traceStart); from <= spanTime && spanTime <= to {
+			hits = fmt.Sprintf("{\"_source\":%s}", spanBytes)
+		}
+		_, _ = rw.Write([]byte(fmt.Sprintf("{\"responses\":[{\"hits\":{\"total\":%d,\"hits\":[%s]}}]}", strings.Count(hits, "_source"), hits)))
+	}))
+	defer lookupServer.Close()
+	lookupReader := NewLogzioSpanReader(LogzioConfig{APIToken: testAPIToken, CustomAPIURL: lookupServer.URL, RetentionDays: 7}, logger)
+
+	trace, err := lookupReader.GetTrace(context.Background(), model.NewTraceID(0, 1))
+	assert.NoError(tester, err)
+	assert.Equal(tester, 1, len(trace.Spans))
+	lock.Lock()
+	assert.Equal(tester, 3, len(requestedWindows), "trace should be found in the third 48 hours window")
+	requestedWindows = nil
+	lock.Unlock()
+
+	_, err = lookupReader.GetTrace(context.Background(), model.NewTraceID(0, 1))
+	assert.NoError(tester, err)
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(tester, []uint64{model.TimeAsEpochMicroseconds(traceStart.Add(-traceStartMargin))}, requestedWindows, "trace start time should be cached")
+}
+
+func TestGetTraceCanceled(tester *testing.T) {
+	release := make(chan struct{})
+	slowServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+	}))
+	defer slowServer.Close()
+	defer close(release)
+	slowReader := NewLogzioSpanReader(LogzioConfig{APIToken: testAPIToken, CustomAPIURL: slowServer.URL}, logger)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	start := time.Now()
+	_, err := slowReader.GetTrace(ctx, model.NewTraceID(0, 1))
+	assert.Equal(tester, context.DeadlineExceeded, err)
+	assert.True(tester, time.Since(start) < time.Second*5, "GetTrace should return once the context is done")
+}
+
+func TestSearchFieldsScopeSearches(tester *testing.T) {
+	scopedServer, recorded := newRecordingServer([]byte(`{"responses":[{"hits":{"hits":[]}}]}`))
+	defer scopedServer.Close()
+	config := LogzioConfig{APIToken: testAPIToken, CustomAPIURL: scopedServer.URL, SearchFields: map[string]string{"env": "staging"}}
+	scopeFilter := "{\"term\":{\"env\":\"staging\"}}"
+
+	scopedReader := NewLogzioSpanReader(config, logger)
+	_, _ = scopedReader.GetTrace(context.Background(), model.TraceID{Low: 1, High: 0})
+	_, _ = scopedReader.GetServices(context.Background())
+	_, _ = scopedReader.GetOperations(context.Background(), spanstore.OperationQueryParameters{ServiceName: testService})
+	searchRequests := recorded.get()
+	assert.NotEmpty(tester, searchRequests)
+	for _, searchRequest := range searchRequests {
+		assert.Contains(tester, searchRequest, scopeFilter)
+	}
+	assert.Contains(tester, searchRequests[len(searchRequests)-1], "{\"term\":{\"serviceName\":\""+testService+"\"}}")
+
+	recorded.reset()
+	_, _ = NewLogzioArchiveSpanReader(config, logger).GetTrace(context.Background(), model.TraceID{Low: 1, High: 0})
+	searchRequests = recorded.get()
+	assert.NotEmpty(tester, searchRequests)
+	assert.NotContains(tester, searchRequests[0], scopeFilter)
+}
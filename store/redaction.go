@@ -0,0 +1,185 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// redaction scopes, a rule without scopes applies to all of them
+	redactionScopeSpan    = "span"
+	redactionScopeProcess = "process"
+	redactionScopeLog     = "log"
+
+	// redaction actions
+	redactionActionDrop     = "drop"
+	redactionActionMask     = "mask"
+	redactionActionHash     = "hash"
+	redactionActionTruncate = "truncate"
+
+	redactedMask = "[REDACTED]"
+)
+
+// RedactionRule masks, hashes, truncates or drops the tags and log fields it matches before spans are written.
+// A tag matches if its key equals Key or matches KeyRegex, and its value matches ValueRegex, empty conditions match any tag.
+// When ValueRegex is set, mask and hash replace only the matching parts of the value
+type RedactionRule struct {
+	Key        string   `yaml:"key" json:"key"`
+	KeyRegex   string   `yaml:"keyRegex" json:"keyRegex"`
+	ValueRegex string   `yaml:"valueRegex" json:"valueRegex"`
+	Scopes     []string `yaml:"scopes" json:"scopes"`
+	Action     string   `yaml:"action" json:"action"`
+	// MaxLength is the length in characters values are truncated to
+	MaxLength int `yaml:"maxLength" json:"maxLength"`
+}
+
+type compiledRedactionRule struct {
+	RedactionRule
+	keyRegex   *regexp.Regexp
+	valueRegex *regexp.Regexp
+	scopes     map[string]bool
+}
+
+// redactor applies the redaction rules in order, a dropped tag isn't matched by the following rules
+type redactor struct {
+	rules []compiledRedactionRule
+}
+
+func newRedactor(rules []RedactionRule) (*redactor, error) {
+	compiledRules := make([]compiledRedactionRule, 0, len(rules))
+	for i, rule := range rules {
+		compiledRule, err := compileRedactionRule(rule)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid redaction rule %d", i+1)
+		}
+		compiledRules = append(compiledRules, compiledRule)
+	}
+	return &redactor{rules: compiledRules}, nil
+}
+
+func compileRedactionRule(rule RedactionRule) (compiledRedactionRule, error) {
+	compiledRule := compiledRedactionRule{RedactionRule: rule, scopes: make(map[string]bool)}
+	if rule.Key == "" && rule.KeyRegex == "" && rule.ValueRegex == "" {
+		return compiledRule, errors.New("one of key, keyRegex or valueRegex is required")
+	}
+	switch rule.Action {
+	case redactionActionDrop, redactionActionMask, redactionActionHash:
+	case redactionActionTruncate:
+		if rule.MaxLength <= 0 {
+			return compiledRule, errors.New("truncate requires a positive maxLength")
+		}
+	default:
+		return compiledRule, fmt.Errorf("unknown action %q, expected one of drop, mask, hash or truncate", rule.Action)
+	}
+	for _, scope := range rule.Scopes {
+		if scope != redactionScopeSpan && scope != redactionScopeProcess && scope != redactionScopeLog {
+			return compiledRule, fmt.Errorf("unknown scope %q, expected one of span, process or log", scope)
+		}
+		compiledRule.scopes[scope] = true
+	}
+	var err error
+	if rule.KeyRegex != "" {
+		if compiledRule.keyRegex, err = regexp.Compile(rule.KeyRegex); err != nil {
+			return compiledRule, errors.Wrap(err, "invalid keyRegex")
+		}
+	}
+	if rule.ValueRegex != "" {
+		if compiledRule.valueRegex, err = regexp.Compile(rule.ValueRegex); err != nil {
+			return compiledRule, errors.Wrap(err, "invalid valueRegex")
+		}
+	}
+	return compiledRule, nil
+}
+
+func (rule *compiledRedactionRule) matches(tag model.KeyValue, value string, scope string) bool {
+	if len(rule.scopes) > 0 && !rule.scopes[scope] {
+		return false
+	}
+	if rule.Key != "" && tag.Key != rule.Key {
+		return false
+	}
+	if rule.keyRegex != nil && !rule.keyRegex.MatchString(tag.Key) {
+		return false
+	}
+	return rule.valueRegex == nil || rule.valueRegex.MatchString(value)
+}
+
+// apply returns the redacted value, or false if the tag should be dropped
+func (rule *compiledRedactionRule) apply(value string) (string, bool) {
+	switch rule.Action {
+	case redactionActionDrop:
+		return "", false
+	case redactionActionMask:
+		if rule.valueRegex != nil {
+			return rule.valueRegex.ReplaceAllLiteralString(value, redactedMask), true
+		}
+		return redactedMask, true
+	case redactionActionHash:
+		if rule.valueRegex != nil {
+			return rule.valueRegex.ReplaceAllStringFunc(value, hashValue), true
+		}
+		return hashValue(value), true
+	case redactionActionTruncate:
+		if runes := []rune(value); len(runes) > rule.MaxLength {
+			return string(runes[:rule.MaxLength]), true
+		}
+	}
+	return value, true
+}
+
+func hashValue(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])
+}
+
+// redactSpan applies the redaction rules to the span tags, process tags and log fields in place
+func (redactor *redactor) redactSpan(span *model.Span) {
+	if len(redactor.rules) == 0 {
+		return
+	}
+	span.Tags = redactor.redactTags(span.Tags, redactionScopeSpan)
+	if span.Process != nil {
+		span.Process.Tags = redactor.redactTags(span.Process.Tags, redactionScopeProcess)
+	}
+	for i := range span.Logs {
+		span.Logs[i].Fields = redactor.redactTags(span.Logs[i].Fields, redactionScopeLog)
+	}
+}
+
+func (redactor *redactor) redactTags(tags []model.KeyValue, scope string) []model.KeyValue {
+	redactedTags := tags[:0]
+	for _, tag := range tags {
+		if redactedTag, keep := redactor.redactTag(tag, scope); keep {
+			redactedTags = append(redactedTags, redactedTag)
+		}
+	}
+	return redactedTags
+}
+
+func (redactor *redactor) redactTag(tag model.KeyValue, scope string) (model.KeyValue, bool) {
+	value := tag.AsString()
+	redacted := false
+	for i := range redactor.rules {
+		rule := &redactor.rules[i]
+		if !rule.matches(tag, value, scope) {
+			continue
+		}
+		redactedValue, keep := rule.apply(value)
+		if !keep {
+			return tag, false
+		}
+		if redactedValue != value {
+			value = redactedValue
+			redacted = true
+		}
+	}
+	if !redacted {
+		return tag, true
+	}
+	return model.String(tag.Key, value), true
+}
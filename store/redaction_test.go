@@ -0,0 +1,60 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactSpan(tester *testing.T) {
+	redactor, err := newRedactor([]RedactionRule{
+		{Key: "http.url", ValueRegex: `\?.*$`, Action: redactionActionMask},
+		{Key: "db.statement", Action: redactionActionDrop},
+		{KeyRegex: `^user\.`, Scopes: []string{redactionScopeSpan}, Action: redactionActionHash},
+		{ValueRegex: `[a-z]+@[a-z]+\.com`, Scopes: []string{redactionScopeLog}, Action: redactionActionMask},
+		{Key: "stack", Action: redactionActionTruncate, MaxLength: 5},
+	})
+	assert.NoError(tester, err)
+	span := &model.Span{
+		Tags: []model.KeyValue{
+			model.String("http.url", "https://example.com/users?token=secret"),
+			model.String("db.statement", "SELECT * FROM users"),
+			model.String("user.email", "john@example.com"),
+			model.Int64("user.id", 42),
+			model.String("stack", "a very long stack"),
+			model.Int64("http.status_code", 200),
+		},
+		Process: model.NewProcess(testService, []model.KeyValue{model.String("user.email", "john@example.com")}),
+		Logs: []model.Log{{Fields: []model.KeyValue{
+			model.String("message", "sent mail to john@example.com"),
+			model.String("db.statement", "SELECT 1"),
+		}}},
+	}
+	redactor.redactSpan(span)
+
+	assert.Equal(tester, []model.KeyValue{
+		model.String("http.url", "https://example.com/users[REDACTED]"),
+		model.String("user.email", hashValue("john@example.com")),
+		model.String("user.id", hashValue("42")),
+		model.String("stack", "a ver"),
+		model.Int64("http.status_code", 200),
+	}, span.Tags)
+	assert.Equal(tester, []model.KeyValue{model.String("user.email", "john@example.com")}, span.Process.Tags, "user rule is scoped to span tags")
+	assert.Equal(tester, []model.KeyValue{model.String("message", "sent mail to [REDACTED]")}, span.Logs[0].Fields)
+}
+
+func TestInvalidRedactionRules(tester *testing.T) {
+	invalidRules := []RedactionRule{
+		{Action: redactionActionDrop},
+		{Key: "key", Action: "encrypt"},
+		{Key: "key", Action: redactionActionTruncate},
+		{Key: "key", Action: redactionActionMask, Scopes: []string{"trace"}},
+		{KeyRegex: "(", Action: redactionActionMask},
+		{ValueRegex: "[", Action: redactionActionMask},
+	}
+	for _, rule := range invalidRules {
+		_, err := newRedactor([]RedactionRule{rule})
+		assert.Error(tester, err, rule)
+	}
+}
@@ -0,0 +1,182 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Errors of the logz.io search api, a SearchError can be matched to them with errors.Is
+var (
+	ErrUnauthorized      = errors.New("logz.io api token is invalid or unauthorized")
+	ErrNotEntitled       = errors.New("logz.io account is not entitled to use the search api")
+	ErrQueryTooLarge     = errors.New("query is too large for the logz.io search api")
+	ErrRateLimited       = errors.New("logz.io search api rate limit exceeded")
+	ErrUpstreamTimeout   = errors.New("logz.io search api timed out")
+	ErrMalformedResponse = errors.New("malformed logz.io search api response")
+)
+
+// SearchError is a failed request to the logz.io search api
+type SearchError struct {
+	// Kind is one of the search api errors, or nil if the failure is not classified
+	Kind error
+	// StatusCode is the http status of the response, 0 if no response was received
+	StatusCode int
+	// ErrorCode is the logz.io error code of the response, if any
+	ErrorCode string
+	// Message is the logz.io error message or the underlying error
+	Message string
+	// RequestID is the logz.io id of the failed request, if any
+	RequestID  string
+	retryable  bool
+	retryAfter time.Duration
+}
+
+func (err *SearchError) Error() string {
+	message := err.Message
+	if err.Kind != nil {
+		message = fmt.Sprintf("%s: %s", err.Kind.Error(), err.Message)
+	}
+	if err.RequestID != "" {
+		message = fmt.Sprintf("%s (request id %s)", message, err.RequestID)
+	}
+	return message
+}
+
+// Unwrap returns the kind of the error
+func (err *SearchError) Unwrap() error {
+	return err.Kind
+}
+
+// logzioErrorResponse is the error body returned by the logz.io api
+type logzioErrorResponse struct {
+	ErrorCode string `json:"errorCode"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId"`
+}
+
+func newRetryableError(err error) error {
+	return &SearchError{Message: err.Error(), retryable: true}
+}
+
+func newMalformedResponseError(err error) error {
+	return &SearchError{Kind: ErrMalformedResponse, Message: err.Error(), retryable: true}
+}
+
+// checkResponseStatus classifies a failed http response. Rate limiting, timeouts and server errors are retryable,
+// other client errors such as an invalid api token are not
+func checkResponseStatus(resp *http.Response, responseBytes []byte) error {
+	if resp.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+	err := newSearchError(responseBytes)
+	err.StatusCode = resp.StatusCode
+	if err.Kind == nil {
+		err.Kind = statusErrorKind(resp.StatusCode)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout ||
+		resp.StatusCode >= http.StatusInternalServerError {
+		err.retryable = true
+		err.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	}
+	return err
+}
+
+// checkErrorResponse returns an error if the response body holds a logz.io error code
+func checkErrorResponse(response []byte) error {
+	var respMap map[string]interface{}
+	_ = json.Unmarshal(response, &respMap)
+	_, exist := respMap["errorCode"]
+	if exist {
+		err := newSearchError(response)
+		err.retryable = err.Kind == ErrRateLimited || err.Kind == ErrUpstreamTimeout
+		return err
+	}
+	return nil
+}
+
+// newSearchError parses the logz.io error body, falling back to the raw body if it isn't one
+func newSearchError(responseBytes []byte) *SearchError {
+	var errorResponse logzioErrorResponse
+	if err := json.Unmarshal(responseBytes, &errorResponse); err != nil || errorResponse.ErrorCode == "" {
+		return &SearchError{Message: strings.TrimSpace(string(responseBytes))}
+	}
+	message := errorResponse.Message
+	if message == "" {
+		message = errorResponse.ErrorCode
+	}
+	return &SearchError{
+		Kind:      errorCodeKind(errorResponse.ErrorCode),
+		ErrorCode: errorResponse.ErrorCode,
+		Message:   message,
+		RequestID: errorResponse.RequestID,
+	}
+}
+
+func statusErrorKind(statusCode int) error {
+	switch statusCode {
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusForbidden, http.StatusPaymentRequired:
+		return ErrNotEntitled
+	case http.StatusRequestEntityTooLarge:
+		return ErrQueryTooLarge
+	case http.StatusTooManyRequests:
+		return ErrRateLimited
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return ErrUpstreamTimeout
+	}
+	return nil
+}
+
+// errorCodeKind classifies a logz.io error code, such as "GENERAL/UNAUTHORIZED"
+func errorCodeKind(errorCode string) error {
+	code := strings.ToUpper(errorCode)
+	switch {
+	case strings.Contains(code, "UNAUTHORIZED") || strings.Contains(code, "TOKEN"):
+		return ErrUnauthorized
+	case strings.Contains(code, "ENTITLE") || strings.Contains(code, "FORBIDDEN"):
+		return ErrNotEntitled
+	case strings.Contains(code, "TOO_LARGE") || strings.Contains(code, "TOO_MANY_BUCKETS"):
+		return ErrQueryTooLarge
+	case strings.Contains(code, "RATE_LIMIT") || strings.Contains(code, "TOO_MANY_REQUESTS"):
+		return ErrRateLimited
+	case strings.Contains(code, "TIMEOUT") || strings.Contains(code, "TIMED_OUT"):
+		return ErrUpstreamTimeout
+	}
+	return nil
+}
+
+// parseRetryAfter parses a Retry-After header in either seconds or http date format
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Second * time.Duration(seconds)
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+func isRetryableError(err error) bool {
+	var searchErr *SearchError
+	return errors.As(err, &searchErr) && searchErr.retryable
+}
+
+func retryAfterDelay(err error) time.Duration {
+	var searchErr *SearchError
+	if errors.As(err, &searchErr) {
+		return searchErr.retryAfter
+	}
+	return 0
+}
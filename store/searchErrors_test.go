@@ -0,0 +1,58 @@
+package store
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchErrorKinds(tester *testing.T) {
+	testCases := []struct {
+		statusCode int
+		body       string
+		kind       error
+		retryable  bool
+	}{
+		{http.StatusUnauthorized, "{\"errorCode\":\"GENERAL/UNAUTHORIZED\",\"message\":\"Insufficient privileges\",\"requestId\":\"42\"}", ErrUnauthorized, false},
+		{http.StatusForbidden, "", ErrNotEntitled, false},
+		{http.StatusRequestEntityTooLarge, "", ErrQueryTooLarge, false},
+		{http.StatusOK, "{\"errorCode\":\"SEARCH/QUERY_TOO_LARGE\",\"message\":\"Query is too large\"}", ErrQueryTooLarge, false},
+		{http.StatusTooManyRequests, "", ErrRateLimited, true},
+		{http.StatusGatewayTimeout, "", ErrUpstreamTimeout, true},
+		{http.StatusOK, "{\"errorCode\":\"SEARCH/TIMEOUT\",\"message\":\"Search timed out\"}", ErrUpstreamTimeout, true},
+		{http.StatusInternalServerError, "oops", nil, true},
+	}
+	for _, testCase := range testCases {
+		resp := &http.Response{StatusCode: testCase.statusCode, Header: http.Header{}}
+		err := checkResponseStatus(resp, []byte(testCase.body))
+		if err == nil {
+			err = checkErrorResponse([]byte(testCase.body))
+		}
+		assert.Error(tester, err, testCase.body)
+		var searchErr *SearchError
+		assert.True(tester, errors.As(err, &searchErr))
+		assert.Equal(tester, testCase.kind, searchErr.Kind, testCase.body)
+		if testCase.kind != nil {
+			assert.True(tester, errors.Is(err, testCase.kind))
+		}
+		assert.Equal(tester, testCase.retryable, isRetryableError(err), testCase.body)
+	}
+	assert.NoError(tester, checkErrorResponse([]byte("{\"responses\":[]}")))
+}
+
+func TestSearchErrorMessage(tester *testing.T) {
+	unauthorizedServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusUnauthorized)
+		_, _ = rw.Write([]byte("{\"errorCode\":\"GENERAL/UNAUTHORIZED\",\"message\":\"Insufficient privileges\",\"requestId\":\"42\"}"))
+	}))
+	defer unauthorizedServer.Close()
+	unauthorizedReader := NewLogzioSpanReader(LogzioConfig{APIToken: "invalidToken", CustomAPIURL: unauthorizedServer.URL}, logger)
+
+	_, err := unauthorizedReader.getSearchResult(context.Background(), "{}\n{}\n")
+	assert.True(tester, errors.Is(err, ErrUnauthorized))
+	assert.Equal(tester, "logz.io api token is invalid or unauthorized: Insufficient privileges (request id 42)", err.Error())
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/avast/retry-go"
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/time/rate"
+)
+
+const (
+	maxRetryAttempts  = 4
+	initialRetryDelay = time.Millisecond * 500
+	maxRetryDelay     = time.Second * 30
+	maxRetryJitter    = time.Millisecond * 500
+)
+
+var (
+	// rate limiters are shared by all the readers of the process which use the same api token
+	rateLimiters     = make(map[string]*rate.Limiter)
+	rateLimitersLock sync.Mutex
+)
+
+func sharedRateLimiter(apiToken string, requestsPerSecond float64) *rate.Limiter {
+	rateLimitersLock.Lock()
+	defer rateLimitersLock.Unlock()
+	limiter, ok := rateLimiters[apiToken]
+	if !ok {
+		burst := int(requestsPerSecond)
+		if burst < 1 {
+			burst = 1
+		}
+		limiter = rate.NewLimiter(rate.Limit(requestsPerSecond), burst)
+		rateLimiters[apiToken] = limiter
+	}
+	return limiter
+}
+
+// searchDelay backs off exponentially with jitter, unless the api asked to retry after a specific delay
+func searchDelay(n uint, err error, config *retry.Config) time.Duration {
+	if delay := retryAfterDelay(err); delay > 0 {
+		return delay
+	}
+	return retry.CombineDelay(retry.BackOffDelay, retry.RandomDelay)(n, err, config)
+}
+
+// searchWithRetry waits for the rate limiter before every attempt and retries only retryable errors
+func searchWithRetry(ctx context.Context, limiter *rate.Limiter, logger hclog.Logger, search func() error) error {
+	return retry.Do(
+		func() error {
+			if err := limiter.Wait(ctx); err != nil {
+				return err
+			}
+			return search()
+		},
+		retry.Context(ctx),
+		retry.LastErrorOnly(true),
+		retry.Attempts(maxRetryAttempts),
+		retry.Delay(initialRetryDelay),
+		retry.MaxDelay(maxRetryDelay),
+		retry.MaxJitter(maxRetryJitter),
+		retry.DelayType(searchDelay),
+		retry.RetryIf(isRetryableError),
+		retry.OnRetry(
+			func(n uint, err error) {
+				searchRetriesTotal.Inc()
+				logger.Debug(fmt.Sprintf("retrying search %d/%d: %s", n+1, maxRetryAttempts, err.Error()))
+			}),
+	)
+}
@@ -0,0 +1,63 @@
+package store
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchRetryAfterRateLimit(tester *testing.T) {
+	var requests int32
+	rateLimitedServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			rw.Header().Set("Retry-After", "1")
+			rw.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = rw.Write([]byte("{\"responses\":[{\"hits\":{\"total\":0,\"hits\":[]}}]}"))
+	}))
+	defer rateLimitedServer.Close()
+	rateLimitedReader := NewLogzioSpanReader(LogzioConfig{APIToken: "rateLimitedToken", CustomAPIURL: rateLimitedServer.URL}, logger)
+
+	start := time.Now()
+	result, err := rateLimitedReader.getSearchResult(context.Background(), "{}\n{}\n")
+	assert.NoError(tester, err)
+	assert.NotNil(tester, result)
+	assert.Equal(tester, int32(2), atomic.LoadInt32(&requests))
+	assert.True(tester, time.Since(start) >= time.Second, "search should wait for the Retry-After delay")
+}
+
+func TestSearchUnauthorizedNotRetried(tester *testing.T) {
+	var requests int32
+	unauthorizedServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		rw.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer unauthorizedServer.Close()
+	unauthorizedReader := NewLogzioSpanReader(LogzioConfig{APIToken: "unauthorizedToken", CustomAPIURL: unauthorizedServer.URL}, logger)
+
+	_, err := unauthorizedReader.getSearchResult(context.Background(), "{}\n{}\n")
+	assert.Error(tester, err)
+	assert.False(tester, isRetryableError(err))
+	assert.True(tester, errors.Is(err, ErrUnauthorized))
+	assert.Equal(tester, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestSharedRateLimiter(tester *testing.T) {
+	assert.True(tester, sharedRateLimiter("sharedToken", 5) == sharedRateLimiter("sharedToken", 5))
+	assert.False(tester, sharedRateLimiter("sharedToken", 5) == sharedRateLimiter("otherToken", 5))
+}
+
+func TestParseRetryAfter(tester *testing.T) {
+	assert.Equal(tester, time.Duration(0), parseRetryAfter(""))
+	assert.Equal(tester, time.Duration(0), parseRetryAfter("soon"))
+	assert.Equal(tester, time.Second*3, parseRetryAfter("3"))
+	delay := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.True(tester, delay > time.Second*50 && delay <= time.Minute)
+}
@@ -0,0 +1,139 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"github.com/uber/jaeger-client-go"
+	j "github.com/uber/jaeger-client-go/thrift-gen/jaeger"
+)
+
+const (
+	selfTracingServiceName = "jaeger-logzio"
+)
+
+type selfTracingContextKey struct{}
+
+// withoutSelfTracing marks the context of the plugin's own spans, no spans are started under it
+// so writing a span of the plugin never creates another span to write
+func withoutSelfTracing(ctx context.Context) context.Context {
+	return context.WithValue(ctx, selfTracingContextKey{}, true)
+}
+
+func isSelfTracingDisabled(ctx context.Context) bool {
+	disabled, _ := ctx.Value(selfTracingContextKey{}).(bool)
+	return disabled
+}
+
+// startSpan starts a span of the plugin operation, unless the context is writing the plugin's own spans
+func startSpan(ctx context.Context, operationName string) (opentracing.Span, context.Context) {
+	if isSelfTracingDisabled(ctx) {
+		return opentracing.NoopTracer{}.StartSpan(operationName), ctx
+	}
+	return opentracing.StartSpanFromContext(ctx, operationName)
+}
+
+// finishSpan marks the span as failed if err is not nil and finishes it
+func finishSpan(span opentracing.Span, err error) {
+	if err != nil {
+		span.SetTag("error", true)
+		span.LogKV("event", "error", "message", err.Error())
+	}
+	span.Finish()
+}
+
+// selfTracingReporter reports the spans of the plugin through the plugin's own span writer
+type selfTracingReporter struct {
+	logger hclog.Logger
+	writer *LogzioSpanWriter
+}
+
+// Report converts the finished span and writes it like any other span
+func (reporter *selfTracingReporter) Report(span *jaeger.Span) {
+	modelSpan := selfTracingSpanToModel(jaeger.BuildJaegerThrift(span), jaeger.BuildJaegerProcessThrift(span))
+	if err := reporter.writer.WriteSpan(withoutSelfTracing(context.Background()), modelSpan); err != nil {
+		reporter.logger.Warn(fmt.Sprintf("can't write self tracing span: %s", err.Error()))
+	}
+}
+
+// Close does nothing, the span writer is closed by the store
+func (reporter *selfTracingReporter) Close() {}
+
+// NewSelfTracer creates a tracer for the operations of the plugin, which writes its spans with the span writer
+func NewSelfTracer(config LogzioConfig, writer *LogzioSpanWriter, logger hclog.Logger) (opentracing.Tracer, io.Closer, error) {
+	if writer == nil || config.AccountToken == "" {
+		return nil, nil, errors.New("self tracing requires an account token to write the spans of the plugin")
+	}
+	sampler, err := jaeger.NewProbabilisticSampler(config.selfTracingRate())
+	if err != nil {
+		return nil, nil, err
+	}
+	tracer, closer := jaeger.NewTracer(selfTracingServiceName, sampler, &selfTracingReporter{logger: logger, writer: writer})
+	return tracer, closer, nil
+}
+
+func selfTracingSpanToModel(span *j.Span, process *j.Process) *model.Span {
+	traceID := model.NewTraceID(uint64(span.TraceIdHigh), uint64(span.TraceIdLow))
+	references := make([]model.SpanRef, 0, len(span.References)+1)
+	hasParentRef := false
+	for _, ref := range span.References {
+		refType := model.ChildOf
+		if ref.RefType == j.SpanRefType_FOLLOWS_FROM {
+			refType = model.FollowsFrom
+		}
+		if ref.SpanId == span.ParentSpanId {
+			hasParentRef = true
+		}
+		references = append(references, model.SpanRef{
+			TraceID: model.NewTraceID(uint64(ref.TraceIdHigh), uint64(ref.TraceIdLow)),
+			SpanID:  model.NewSpanID(uint64(ref.SpanId)),
+			RefType: refType,
+		})
+	}
+	if span.ParentSpanId != 0 && !hasParentRef {
+		references = append(references, model.NewChildOfRef(traceID, model.NewSpanID(uint64(span.ParentSpanId))))
+	}
+	logs := make([]model.Log, 0, len(span.Logs))
+	for _, log := range span.Logs {
+		logs = append(logs, model.Log{
+			Timestamp: model.EpochMicrosecondsAsTime(uint64(log.Timestamp)),
+			Fields:    selfTracingTagsToModel(log.Fields),
+		})
+	}
+	return &model.Span{
+		TraceID:       traceID,
+		SpanID:        model.NewSpanID(uint64(span.SpanId)),
+		OperationName: span.OperationName,
+		References:    references,
+		Flags:         model.Flags(span.Flags),
+		StartTime:     model.EpochMicrosecondsAsTime(uint64(span.StartTime)),
+		Duration:      model.MicrosecondsAsDuration(uint64(span.Duration)),
+		Tags:          selfTracingTagsToModel(span.Tags),
+		Logs:          logs,
+		Process:       model.NewProcess(process.ServiceName, selfTracingTagsToModel(process.Tags)),
+	}
+}
+
+func selfTracingTagsToModel(tags []*j.Tag) []model.KeyValue {
+	keyValues := make([]model.KeyValue, 0, len(tags))
+	for _, tag := range tags {
+		switch tag.VType {
+		case j.TagType_STRING:
+			keyValues = append(keyValues, model.String(tag.Key, tag.GetVStr()))
+		case j.TagType_DOUBLE:
+			keyValues = append(keyValues, model.Float64(tag.Key, tag.GetVDouble()))
+		case j.TagType_BOOL:
+			keyValues = append(keyValues, model.Bool(tag.Key, tag.GetVBool()))
+		case j.TagType_LONG:
+			keyValues = append(keyValues, model.Int64(tag.Key, tag.GetVLong()))
+		case j.TagType_BINARY:
+			keyValues = append(keyValues, model.Binary(tag.Key, tag.GetVBinary()))
+		}
+	}
+	return keyValues
+}
@@ -0,0 +1,85 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber/jaeger-client-go"
+)
+
+func TestSelfTracer(tester *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	config := LogzioConfig{AccountToken: testAccountToken, CustomListenerURL: server.URL, InMemoryQueue: true, InMemoryCapacity: defaultInMemoryCapacity, SelfTracing: true}
+	writer, err := NewLogzioSpanWriter(config, logger)
+	assert.NoError(tester, err)
+	defer writer.Close()
+	tracer, closer, err := NewSelfTracer(config, writer, logger)
+	assert.NoError(tester, err)
+	defer closer.Close()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	spansWritten := testutil.ToFloat64(spansWrittenTotal.WithLabelValues(spanDocumentType))
+	parent, ctx := startSpan(context.Background(), "parent")
+	child, _ := startSpan(ctx, "child")
+	finishSpan(child, errors.New("failed"))
+	parent.Finish()
+	assert.Equal(tester, spansWritten+2, testutil.ToFloat64(spansWrittenTotal.WithLabelValues(spanDocumentType)))
+
+	guarded, guardedCtx := startSpan(withoutSelfTracing(ctx), "guarded")
+	_, isJaegerSpan := guarded.(*jaeger.Span)
+	assert.False(tester, isJaegerSpan, "spans must not be started while writing the plugin's own spans")
+	assert.True(tester, isSelfTracingDisabled(guardedCtx))
+	guarded.Finish()
+	assert.Equal(tester, spansWritten+2, testutil.ToFloat64(spansWrittenTotal.WithLabelValues(spanDocumentType)))
+}
+
+func TestNewSelfTracerWithoutAccountToken(tester *testing.T) {
+	_, _, err := NewSelfTracer(LogzioConfig{APIToken: testAPIToken, SelfTracing: true}, nil, logger)
+	assert.Error(tester, err)
+}
+
+func TestSelfTracingSpanToModel(tester *testing.T) {
+	var reported *model.Span
+	tracer, closer := jaeger.NewTracer(selfTracingServiceName, jaeger.NewConstSampler(true), reporterFunc(func(span *jaeger.Span) {
+		reported = selfTracingSpanToModel(jaeger.BuildJaegerThrift(span), jaeger.BuildJaegerProcessThrift(span))
+	}))
+	defer closer.Close()
+
+	parent := tracer.StartSpan("parent")
+	child := tracer.StartSpan("child", opentracing.ChildOf(parent.Context()))
+	child.SetTag("bulk", 3)
+	child.SetTag("error", true)
+	child.LogKV("message", "failed")
+	child.Finish()
+
+	parentContext := parent.Context().(jaeger.SpanContext)
+	assert.Equal(tester, "child", reported.OperationName)
+	assert.Equal(tester, selfTracingServiceName, reported.Process.ServiceName)
+	assert.Equal(tester, model.SpanID(parentContext.SpanID()), reported.ParentSpanID())
+	assert.Equal(tester, parentContext.TraceID().Low, reported.TraceID.Low)
+	bulk, _ := model.KeyValues(reported.Tags).FindByKey("bulk")
+	assert.Equal(tester, int64(3), bulk.Int64())
+	errorTag, _ := model.KeyValues(reported.Tags).FindByKey("error")
+	assert.True(tester, errorTag.Bool())
+	assert.Equal(tester, 1, len(reported.Logs))
+	assert.Equal(tester, "failed", reported.Logs[0].Fields[0].VStr)
+}
+
+type reporterFunc func(span *jaeger.Span)
+
+func (report reporterFunc) Report(span *jaeger.Span) {
+	report(span)
+}
+
+func (report reporterFunc) Close() {}
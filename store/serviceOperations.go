@@ -53,6 +53,13 @@ func (soStorage *ServiceOperationStorage) getUniqueValues(context context.Contex
 		IgnoreUnavailable(true).
 		Aggregation(aggregationString, serviceFilter)
 
+	if len(soStorage.reader.searchFields) > 0 {
+		boolQuery := elastic.NewBoolQuery().Filter(soStorage.reader.searchFields...)
+		if termsQuery != nil {
+			boolQuery.Filter(termsQuery)
+		}
+		termsQuery = boolQuery
+	}
 	if termsQuery != nil {
 		searchRequest = searchRequest.Query(termsQuery)
 	}
@@ -62,7 +69,7 @@ func (soStorage *ServiceOperationStorage) getUniqueValues(context context.Contex
 	}
 	searchBody = fmt.Sprintf("{}\n%s\n", searchBody)
 
-	searchResult, err := soStorage.reader.getSearchResult(searchBody)
+	searchResult, err := soStorage.reader.getSearchResult(context, searchBody)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to execute search service request")
 	}
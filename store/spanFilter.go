@@ -0,0 +1,194 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// filter actions
+	filterActionDrop   = "drop"
+	filterActionKeep   = "keep"
+	filterActionSample = "sample"
+)
+
+// FilterRule decides whether the spans it matches are written. A span matches if all the set conditions match it.
+// Rules are evaluated in order and the first matching rule decides, spans which match no rule are written.
+// The sample action keeps SampleRate of the traces, the decision is consistent per trace id
+// so all the spans of a trace are kept or dropped together. A sample rule has no conditions, as a rule scoped by
+// service would drop only the spans of the service from the sampled out traces
+type FilterRule struct {
+	// Name identifies the rule in logs and metrics, defaults to its position
+	Name           string `yaml:"name" json:"name"`
+	Service        string `yaml:"service" json:"service"`
+	ServiceRegex   string `yaml:"serviceRegex" json:"serviceRegex"`
+	Operation      string `yaml:"operation" json:"operation"`
+	OperationRegex string `yaml:"operationRegex" json:"operationRegex"`
+	// Tags maps tag keys to regexes their values must match
+	Tags map[string]string `yaml:"tags" json:"tags"`
+	// MinDuration and MaxDuration match spans by their duration, for example "10ms"
+	MinDuration string  `yaml:"minDuration" json:"minDuration"`
+	MaxDuration string  `yaml:"maxDuration" json:"maxDuration"`
+	Action      string  `yaml:"action" json:"action"`
+	SampleRate  float64 `yaml:"sampleRate" json:"sampleRate"`
+}
+
+type compiledFilterRule struct {
+	FilterRule
+	serviceRegex   *regexp.Regexp
+	operationRegex *regexp.Regexp
+	tagRegexes     map[string]*regexp.Regexp
+	minDuration    time.Duration
+	maxDuration    time.Duration
+	dropped        uint64
+}
+
+// spanFilter drops spans by the filter rules before they are written
+type spanFilter struct {
+	rules []*compiledFilterRule
+}
+
+func newSpanFilter(rules []FilterRule) (*spanFilter, error) {
+	compiledRules := make([]*compiledFilterRule, 0, len(rules))
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		compiledRule, err := compileFilterRule(rule)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid filter rule %s", rule.Name)
+		}
+		compiledRules = append(compiledRules, compiledRule)
+	}
+	return &spanFilter{rules: compiledRules}, nil
+}
+
+func compileFilterRule(rule FilterRule) (*compiledFilterRule, error) {
+	compiledRule := &compiledFilterRule{FilterRule: rule, tagRegexes: make(map[string]*regexp.Regexp)}
+	switch rule.Action {
+	case filterActionDrop, filterActionKeep:
+	case filterActionSample:
+		if rule.SampleRate < 0 || rule.SampleRate > 1 {
+			return nil, errors.New("sampleRate must be between 0 and 1")
+		}
+		if rule.isScoped() {
+			return nil, errors.New("sample rules can't have conditions, they sample whole traces by their trace id")
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %q, expected one of drop, keep or sample", rule.Action)
+	}
+	var err error
+	if rule.ServiceRegex != "" {
+		if compiledRule.serviceRegex, err = regexp.Compile(rule.ServiceRegex); err != nil {
+			return nil, errors.Wrap(err, "invalid serviceRegex")
+		}
+	}
+	if rule.OperationRegex != "" {
+		if compiledRule.operationRegex, err = regexp.Compile(rule.OperationRegex); err != nil {
+			return nil, errors.Wrap(err, "invalid operationRegex")
+		}
+	}
+	for key, valueRegex := range rule.Tags {
+		if compiledRule.tagRegexes[key], err = regexp.Compile(valueRegex); err != nil {
+			return nil, errors.Wrapf(err, "invalid regex of tag %s", key)
+		}
+	}
+	if rule.MinDuration != "" {
+		if compiledRule.minDuration, err = time.ParseDuration(rule.MinDuration); err != nil {
+			return nil, errors.Wrap(err, "invalid minDuration")
+		}
+	}
+	if rule.MaxDuration != "" {
+		if compiledRule.maxDuration, err = time.ParseDuration(rule.MaxDuration); err != nil {
+			return nil, errors.Wrap(err, "invalid maxDuration")
+		}
+	}
+	return compiledRule, nil
+}
+
+// isScoped returns whether the rule has conditions, so it matches only some of the spans of a trace
+func (rule FilterRule) isScoped() bool {
+	return rule.Service != "" || rule.ServiceRegex != "" || rule.Operation != "" || rule.OperationRegex != "" ||
+		len(rule.Tags) > 0 || rule.MinDuration != "" || rule.MaxDuration != ""
+}
+
+func (rule *compiledFilterRule) matches(span *model.Span) bool {
+	serviceName := span.GetProcess().GetServiceName()
+	if rule.Service != "" && serviceName != rule.Service {
+		return false
+	}
+	if rule.serviceRegex != nil && !rule.serviceRegex.MatchString(serviceName) {
+		return false
+	}
+	if rule.Operation != "" && span.OperationName != rule.Operation {
+		return false
+	}
+	if rule.operationRegex != nil && !rule.operationRegex.MatchString(span.OperationName) {
+		return false
+	}
+	if rule.minDuration > 0 && span.Duration < rule.minDuration {
+		return false
+	}
+	if rule.maxDuration > 0 && span.Duration > rule.maxDuration {
+		return false
+	}
+	for key, valueRegex := range rule.tagRegexes {
+		tag, found := model.KeyValues(span.Tags).FindByKey(key)
+		if !found || !valueRegex.MatchString(tag.AsString()) {
+			return false
+		}
+	}
+	return true
+}
+
+// keep returns false if the first rule which matches the span drops it
+func (filter *spanFilter) keep(span *model.Span) bool {
+	for _, rule := range filter.rules {
+		if !rule.matches(span) {
+			continue
+		}
+		keep := rule.Action == filterActionKeep ||
+			(rule.Action == filterActionSample && isTraceSampled(span.TraceID, rule.SampleRate))
+		if !keep {
+			atomic.AddUint64(&rule.dropped, 1)
+			spansFilteredTotal.WithLabelValues(rule.Name).Inc()
+		}
+		return keep
+	}
+	return true
+}
+
+// isTraceSampled hashes the trace id so the same traces are sampled by all the spans and all the collectors
+func isTraceSampled(traceID model.TraceID, sampleRate float64) bool {
+	return float64(mixBits(traceID.High^mixBits(traceID.Low))) < sampleRate*math.MaxUint64
+}
+
+// mixBits is the murmur3 64 bit finalizer, it spreads trace ids which aren't random, such as sequential ids
+func mixBits(value uint64) uint64 {
+	value ^= value >> 33
+	value *= 0xff51afd7ed558ccd
+	value ^= value >> 33
+	value *= 0xc4ceb9fe1a85ec53
+	value ^= value >> 33
+	return value
+}
+
+// logDropped logs the number of spans each of the rules dropped
+func (filter *spanFilter) logDropped(logger hclog.Logger) {
+	if len(filter.rules) == 0 {
+		return
+	}
+	counts := make([]string, 0, len(filter.rules))
+	for _, rule := range filter.rules {
+		counts = append(counts, fmt.Sprintf("%s: %d", rule.Name, atomic.LoadUint64(&rule.dropped)))
+	}
+	logger.Info(fmt.Sprintf("spans dropped by filter rules: %s", strings.Join(counts, ", ")))
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func filterTestSpan(traceID uint64, service, operation string, duration time.Duration, tags ...model.KeyValue) *model.Span {
+	return &model.Span{
+		TraceID:       model.NewTraceID(0, traceID),
+		OperationName: operation,
+		Duration:      duration,
+		Tags:          tags,
+		Process:       model.NewProcess(service, nil),
+	}
+}
+
+func TestSpanFilterRules(tester *testing.T) {
+	filter, err := newSpanFilter([]FilterRule{
+		{Name: "keep-errors", Tags: map[string]string{"error": "^true$"}, Action: filterActionKeep},
+		{Name: "health-checks", OperationRegex: "^GET /health", Action: filterActionDrop},
+		{Service: "lb", MaxDuration: "1ms", Action: filterActionDrop},
+	})
+	assert.NoError(tester, err)
+	dropped := testutil.ToFloat64(spansFilteredTotal.WithLabelValues("health-checks"))
+
+	assert.False(tester, filter.keep(filterTestSpan(1, "api", "GET /health/live", time.Second)))
+	assert.True(tester, filter.keep(filterTestSpan(1, "api", "GET /health/live", time.Second, model.Bool("error", true))))
+	assert.True(tester, filter.keep(filterTestSpan(1, "api", "GET /users", time.Second)))
+	assert.False(tester, filter.keep(filterTestSpan(1, "lb", "proxy", time.Microsecond)))
+	assert.True(tester, filter.keep(filterTestSpan(1, "lb", "proxy", time.Second)))
+	assert.True(tester, filter.keep(filterTestSpan(1, "noisy", "poll", time.Second)), "spans which match no rule should be written")
+	assert.Equal(tester, dropped+1, testutil.ToFloat64(spansFilteredTotal.WithLabelValues("health-checks")))
+	assert.Equal(tester, uint64(1), filter.rules[2].dropped)
+	assert.Equal(tester, "rule-3", filter.rules[2].Name)
+}
+
+func TestSpanFilterSampleConsistentPerTrace(tester *testing.T) {
+	filter, err := newSpanFilter([]FilterRule{
+		{OperationRegex: "^GET /health", Action: filterActionDrop},
+		{Action: filterActionSample, SampleRate: 0.5},
+	})
+	assert.NoError(tester, err)
+	assert.False(tester, filter.keep(filterTestSpan(1, "sampled-frontend", "GET /health", time.Second)), "earlier rules should decide before sampling")
+	kept := 0
+	for traceID := uint64(1); traceID <= 1000; traceID++ {
+		frontend := filter.keep(filterTestSpan(traceID, "sampled-frontend", "request", time.Second))
+		backend := filter.keep(filterTestSpan(traceID, "sampled-backend", "query", time.Second))
+		assert.Equal(tester, frontend, backend, "all the spans of a trace should be sampled together")
+		if frontend {
+			kept++
+		}
+	}
+	assert.InDelta(tester, 500, kept, 100)
+}
+
+func TestInvalidFilterRules(tester *testing.T) {
+	invalidRules := []FilterRule{
+		{Service: "api", Action: "ignore"},
+		{Action: filterActionSample, SampleRate: 2},
+		{Service: "api", Action: filterActionSample, SampleRate: 0.5},
+		{Tags: map[string]string{"http.route": "^/poll$"}, Action: filterActionSample, SampleRate: 0.5},
+		{ServiceRegex: "(", Action: filterActionDrop},
+		{OperationRegex: "(", Action: filterActionDrop},
+		{Tags: map[string]string{"error": "("}, Action: filterActionDrop},
+		{MinDuration: "soon", Action: filterActionDrop},
+	}
+	for _, rule := range invalidRules {
+		_, err := newSpanFilter([]FilterRule{rule})
+		assert.Error(tester, err, rule)
+	}
+}
@@ -0,0 +1,156 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// truncatedTagKey is the tag which lists what was cut from a truncated span, it's prefixed so it doesn't collide
+	// with a truncated tag of the instrumented application
+	truncatedTagKey = "logzio.truncated"
+	// tag values of documents above the size limit are truncated to this length, after their logs are dropped
+	oversizedTagValueLength = 1024
+)
+
+// ErrSpanTooLarge is returned when a span is above the document size limit even after it was truncated
+var ErrSpanTooLarge = errors.New("span document is too large")
+
+// SpanLimits bounds the size of the span documents shipped to logz.io, a limit of 0 disables it.
+// A truncated span gets a logzio.truncated tag which lists what was cut
+type SpanLimits struct {
+	// MaxTagValueLength is the length in characters tag and log field values are truncated to
+	MaxTagValueLength int `yaml:"maxTagValueLength"`
+	// MaxLogs is the number of logs kept per span, the latest logs are dropped
+	MaxLogs int `yaml:"maxLogs"`
+	// MaxLogFields is the number of fields kept per log
+	MaxLogFields int `yaml:"maxLogFields"`
+	// MaxDocumentBytes bounds the size of the span document, the logs of a larger span are dropped
+	// and then its tag values are truncated
+	MaxDocumentBytes int `yaml:"maxDocumentBytes"`
+}
+
+// spanTruncation collects what was cut from a span, the truncated values and the numbers of dropped logs and log fields
+type spanTruncation struct {
+	values           map[string]bool
+	droppedLogs      int
+	droppedLogFields int
+}
+
+func newSpanTruncation() *spanTruncation {
+	return &spanTruncation{values: make(map[string]bool)}
+}
+
+func (truncation *spanTruncation) truncated() bool {
+	return len(truncation.values) > 0 || truncation.droppedLogs > 0 || truncation.droppedLogFields > 0
+}
+
+func (truncation *spanTruncation) String() string {
+	markers := make([]string, 0, len(truncation.values)+2)
+	for marker := range truncation.values {
+		markers = append(markers, marker)
+	}
+	if truncation.droppedLogs > 0 {
+		markers = append(markers, fmt.Sprintf("logs:%d", truncation.droppedLogs))
+	}
+	if truncation.droppedLogFields > 0 {
+		markers = append(markers, fmt.Sprintf("log.fields:%d", truncation.droppedLogFields))
+	}
+	sort.Strings(markers)
+	return strings.Join(markers, ",")
+}
+
+// transformSpan applies the limits to the span in place and returns its document
+func (limits SpanLimits) transformSpan(span *model.Span, transform func(*model.Span) ([]byte, error)) ([]byte, error) {
+	truncation := newSpanTruncation()
+	spanBytes, err := limits.limitSpan(span, truncation, transform)
+	if truncation.truncated() {
+		spansTruncatedTotal.Inc()
+	}
+	return spanBytes, err
+}
+
+// limitSpan truncates the span until its document is within the size limit
+func (limits SpanLimits) limitSpan(span *model.Span, truncation *spanTruncation, transform func(*model.Span) ([]byte, error)) ([]byte, error) {
+	limits.truncateSpan(span, truncation)
+	spanBytes, err := transform(limits.markTruncated(span, truncation))
+	if err != nil || limits.MaxDocumentBytes <= 0 || len(spanBytes) <= limits.MaxDocumentBytes {
+		return spanBytes, err
+	}
+
+	if len(span.Logs) > 0 {
+		truncation.droppedLogs += len(span.Logs)
+		span.Logs = nil
+		if spanBytes, err = transform(limits.markTruncated(span, truncation)); err != nil || len(spanBytes) <= limits.MaxDocumentBytes {
+			return spanBytes, err
+		}
+	}
+	span.Tags = truncateTagValues(span.Tags, oversizedTagValueLength, "tag", truncation)
+	if span.Process != nil {
+		span.Process.Tags = truncateTagValues(span.Process.Tags, oversizedTagValueLength, "process.tag", truncation)
+	}
+	if spanBytes, err = transform(limits.markTruncated(span, truncation)); err != nil || len(spanBytes) <= limits.MaxDocumentBytes {
+		return spanBytes, err
+	}
+	return nil, errors.Wrapf(ErrSpanTooLarge, "span %s of trace %s is %d bytes", span.SpanID, span.TraceID, len(spanBytes))
+}
+
+// truncateSpan applies the tag value, logs and log fields limits
+func (limits SpanLimits) truncateSpan(span *model.Span, truncation *spanTruncation) {
+	if limits.MaxLogs > 0 && len(span.Logs) > limits.MaxLogs {
+		truncation.droppedLogs += len(span.Logs) - limits.MaxLogs
+		span.Logs = span.Logs[:limits.MaxLogs]
+	}
+	for i := range span.Logs {
+		if limits.MaxLogFields > 0 && len(span.Logs[i].Fields) > limits.MaxLogFields {
+			truncation.droppedLogFields += len(span.Logs[i].Fields) - limits.MaxLogFields
+			span.Logs[i].Fields = span.Logs[i].Fields[:limits.MaxLogFields]
+		}
+		span.Logs[i].Fields = truncateTagValues(span.Logs[i].Fields, limits.MaxTagValueLength, "log.field", truncation)
+	}
+	span.Tags = truncateTagValues(span.Tags, limits.MaxTagValueLength, "tag", truncation)
+	if span.Process != nil {
+		span.Process.Tags = truncateTagValues(span.Process.Tags, limits.MaxTagValueLength, "process.tag", truncation)
+	}
+}
+
+// markTruncated sets the truncated tag of the span, if anything was cut from it
+func (limits SpanLimits) markTruncated(span *model.Span, truncation *spanTruncation) *model.Span {
+	if !truncation.truncated() {
+		return span
+	}
+	marker := model.String(truncatedTagKey, truncation.String())
+	for i := range span.Tags {
+		if span.Tags[i].Key == truncatedTagKey {
+			span.Tags[i] = marker
+			return span
+		}
+	}
+	span.Tags = append(span.Tags, marker)
+	return span
+}
+
+func truncateTagValues(tags []model.KeyValue, maxLength int, scope string, truncation *spanTruncation) []model.KeyValue {
+	if maxLength <= 0 {
+		return tags
+	}
+	for i, tag := range tags {
+		switch tag.VType {
+		case model.StringType:
+			if runes := []rune(tag.VStr); len(runes) > maxLength {
+				tags[i] = model.String(tag.Key, string(runes[:maxLength]))
+				truncation.values[fmt.Sprintf("%s:%s", scope, tag.Key)] = true
+			}
+		case model.BinaryType:
+			if len(tag.VBinary) > maxLength {
+				tags[i] = model.Binary(tag.Key, tag.VBinary[:maxLength])
+				truncation.values[fmt.Sprintf("%s:%s", scope, tag.Key)] = true
+			}
+		}
+	}
+	return tags
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/logzio/jaeger-logzio/store/objects"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func limitsTestSpan(logs int, fieldsPerLog int, tags ...model.KeyValue) *model.Span {
+	span := filterTestSpan(1, "api", "query", time.Second, tags...)
+	for i := 0; i < logs; i++ {
+		log := model.Log{Timestamp: time.Unix(int64(i), 0)}
+		for j := 0; j < fieldsPerLog; j++ {
+			log.Fields = append(log.Fields, model.String("field", "value"))
+		}
+		span.Logs = append(span.Logs, log)
+	}
+	return span
+}
+
+func truncatedTag(span *model.Span) string {
+	tag, _ := model.KeyValues(span.Tags).FindByKey(truncatedTagKey)
+	return tag.AsString()
+}
+
+func TestSpanLimitsTruncation(tester *testing.T) {
+	limits := SpanLimits{MaxTagValueLength: 5, MaxLogs: 2, MaxLogFields: 1}
+	span := limitsTestSpan(3, 2, model.String("db.statement", "select * from users"), model.Int64("rows", 100000000))
+	span.Process.Tags = []model.KeyValue{model.Binary("payload", []byte("0123456789"))}
+
+	_, err := limits.transformSpan(span, objects.TransformToLogzioSpanBytes)
+	assert.NoError(tester, err)
+	assert.Equal(tester, "selec", span.Tags[0].VStr)
+	assert.Equal(tester, int64(100000000), span.Tags[1].VInt64)
+	assert.Equal(tester, []byte("01234"), span.Process.Tags[0].VBinary)
+	assert.Len(tester, span.Logs, 2)
+	assert.Len(tester, span.Logs[1].Fields, 1)
+	assert.Equal(tester, "log.fields:2,logs:1,process.tag:payload,tag:db.statement", truncatedTag(span))
+}
+
+func TestSpanLimitsUntouchedSpan(tester *testing.T) {
+	limits := SpanLimits{MaxTagValueLength: 100, MaxLogs: 10, MaxLogFields: 10, MaxDocumentBytes: defaultSpanMaxDocumentBytes}
+	span := limitsTestSpan(2, 2, model.String("db.statement", "select 1"))
+	expected, err := objects.TransformToLogzioSpanBytes(limitsTestSpan(2, 2, model.String("db.statement", "select 1")))
+	assert.NoError(tester, err)
+
+	spanBytes, err := limits.transformSpan(span, objects.TransformToLogzioSpanBytes)
+	assert.NoError(tester, err)
+	assert.Equal(tester, string(expected), string(spanBytes))
+	assert.Empty(tester, truncatedTag(span))
+}
+
+func TestSpanLimitsDocumentSize(tester *testing.T) {
+	limits := SpanLimits{MaxDocumentBytes: 4000}
+	span := limitsTestSpan(100, 5)
+	spanBytes, err := limits.transformSpan(span, objects.TransformToLogzioSpanBytes)
+	assert.NoError(tester, err)
+	assert.LessOrEqual(tester, len(spanBytes), 4000)
+	assert.Empty(tester, span.Logs)
+	assert.Equal(tester, "logs:100", truncatedTag(span))
+
+	span = limitsTestSpan(1, 1, model.String("db.statement", strings.Repeat("x", 5000)))
+	spanBytes, err = limits.transformSpan(span, objects.TransformToLogzioSpanBytes)
+	assert.NoError(tester, err)
+	assert.LessOrEqual(tester, len(spanBytes), 4000)
+	assert.Len(tester, span.Tags[0].VStr, oversizedTagValueLength)
+	assert.Equal(tester, "logs:1,tag:db.statement", truncatedTag(span))
+
+	var tags []model.KeyValue
+	for i := 0; i < 10; i++ {
+		tags = append(tags, model.String(strings.Repeat("k", 1000)+string(rune('a'+i)), "value"))
+	}
+	_, err = limits.transformSpan(limitsTestSpan(0, 0, tags...), objects.TransformToLogzioSpanBytes)
+	assert.True(tester, errors.Is(err, ErrSpanTooLarge))
+}
+
+func TestSpanLimitsTruncatedMarker(tester *testing.T) {
+	limits := SpanLimits{MaxLogs: 50, MaxDocumentBytes: 4000}
+	span := limitsTestSpan(100, 5, model.String("truncated", "false"))
+	truncated := testutil.ToFloat64(spansTruncatedTotal)
+
+	_, err := limits.transformSpan(span, objects.TransformToLogzioSpanBytes)
+	assert.NoError(tester, err)
+	assert.Equal(tester, "logs:100", truncatedTag(span), "the logs dropped by both limits should be counted together")
+	userTag, _ := model.KeyValues(span.Tags).FindByKey("truncated")
+	assert.Equal(tester, "false", userTag.AsString())
+	assert.Equal(tester, truncated+1, testutil.ToFloat64(spansTruncatedTotal))
+}
@@ -1,47 +1,227 @@
 package store
 
 import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
 	"github.com/jaegertracing/jaeger/storage/dependencystore"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrReadDisabled is returned by the span readers of a write-only store
+	ErrReadDisabled = errors.New("reading traces is disabled, no logz.io api token is configured")
+	// ErrWriteDisabled is returned by the span writers of a read-only store
+	ErrWriteDisabled = errors.New("writing spans is disabled, no logz.io account token is configured")
 )
 
 // Store is span store struct for logzio jaeger span storage
 type Store struct {
-	reader *LogzioSpanReader
-	writer *LogzioSpanWriter
+	// readers and writers are nil when the store is write-only or read-only
+	reader        *LogzioSpanReader
+	writer        *LogzioSpanWriter
+	archiveReader *LogzioSpanReader
+	archiveWriter *LogzioArchiveSpanWriter
+	// tenantReader and tenantWriter route the queries and spans of the tenants, they are nil without tenants
+	tenantReader *tenantSpanReader
+	tenantWriter *tenantSpanWriter
+	summary      string
 }
 
-// NewLogzioStore creates a new logzio span store for jaeger
-func NewLogzioStore(config LogzioConfig, logger hclog.Logger) *Store {
-	reader := NewLogzioSpanReader(config, logger)
-	writer, err := NewLogzioSpanWriter(config, logger)
+// NewLogzioStore creates a new logzio span store for jaeger.
+// The store is read-only if there's no account token and write-only if there's no api token,
+// an error is returned if one of the enabled readers or writers can't be created
+func NewLogzioStore(config LogzioConfig, logger hclog.Logger) (*Store, error) {
+	store := &Store{}
+	if config.APIToken != "" {
+		store.reader = NewLogzioSpanReader(config, logger)
+	}
+	if config.archiveAPIToken() != "" {
+		store.archiveReader = NewLogzioArchiveSpanReader(config, logger)
+	}
+	if config.AccountToken != "" {
+		writer, err := NewLogzioSpanWriter(config, logger)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create logzio span writer")
+		}
+		store.writer = writer
+	}
+	if config.archiveAccountToken() != "" {
+		archiveWriter, err := NewLogzioArchiveSpanWriter(config, logger)
+		if err != nil {
+			store.Close()
+			return nil, errors.Wrap(err, "failed to create logzio archive span writer")
+		}
+		store.archiveWriter = archiveWriter
+	}
+	if len(config.Tenants) > 0 {
+		if err := store.createTenants(config, logger); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+	store.summary = storeSummary(config, store)
+	return store, nil
+}
+
+// createTenants creates a reader for every tenant with an api token and a writer for every tenant with an account token
+func (store *Store) createTenants(config LogzioConfig, logger hclog.Logger) error {
+	router, err := newTenantRouter(config.TenantHeader, config.Tenants)
 	if err != nil {
-		logger.Error("Failed to create logzio span writer: " + err.Error())
+		return err
+	}
+	store.tenantReader = &tenantSpanReader{router: router, defaultReader: store.reader, readers: make(map[string]*LogzioSpanReader)}
+	store.tenantWriter = &tenantSpanWriter{router: router, defaultWriter: store.writer, writers: make(map[string]*LogzioSpanWriter)}
+	for _, tenant := range config.Tenants {
+		if tenant.APIToken != "" {
+			tenantConfig := config
+			if tenant.APIURL != "" {
+				tenantConfig.CustomAPIURL = tenant.APIURL
+			}
+			store.tenantReader.readers[tenant.Name] = newLogzioSpanReader(tenantConfig, tenant.APIToken, spanDocumentType, false, logger)
+		}
+		if tenant.AccountToken != "" {
+			writer, err := newLogzioSpanWriter(config, tenant.AccountToken, tenant.Name, logger)
+			if err != nil {
+				return errors.Wrapf(err, "failed to create logzio span writer of tenant %s", tenant.Name)
+			}
+			store.tenantWriter.writers[tenant.Name] = writer
+		}
+	}
+	return nil
+}
+
+// storeSummary describes which capabilities of the store are enabled
+func storeSummary(config LogzioConfig, store *Store) string {
+	capabilities := []string{
+		fmt.Sprintf("read traces: %s", enabledString(store.reader != nil)),
+		fmt.Sprintf("write spans: %s", enabledString(store.writer != nil)),
+		fmt.Sprintf("read archived traces: %s", enabledString(store.archiveReader != nil)),
+		fmt.Sprintf("write archived traces: %s", enabledString(store.archiveWriter != nil)),
+		fmt.Sprintf("write dependencies: %s", enabledString(store.writer != nil && config.WriteDependencies)),
+		fmt.Sprintf("metrics: %s", enabledString(config.MetricsAddress != "")),
+		fmt.Sprintf("health checks: %s", enabledString(config.HealthAddress != "")),
+		fmt.Sprintf("self tracing: %s", enabledString(store.writer != nil && config.SelfTracing)),
+		fmt.Sprintf("tail sampling: %s", enabledString(store.writer != nil && config.TailSampling.Enabled)),
+		fmt.Sprintf("tenants: %d", len(config.Tenants)),
 	}
-	store := &Store{
-		reader: reader,
-		writer: writer,
+	return fmt.Sprintf("logz.io storage capabilities: %s", strings.Join(capabilities, ", "))
+}
+
+func enabledString(enabled bool) string {
+	if enabled {
+		return "enabled"
 	}
-	return store
+	return "disabled"
+}
+
+// Summary describes which capabilities of the store are enabled
+func (store *Store) Summary() string {
+	return store.summary
 }
 
 // Close the span store
 func (store *Store) Close() {
-	store.writer.Close()
+	if store.writer != nil {
+		store.writer.Close()
+	}
+	if store.archiveWriter != nil {
+		store.archiveWriter.Close()
+	}
+	if store.tenantWriter != nil {
+		store.tenantWriter.close()
+	}
 }
 
 // SpanReader returns the created logzio span reader
 func (store *Store) SpanReader() spanstore.Reader {
+	if store.tenantReader != nil {
+		return store.tenantReader
+	}
+	if store.reader == nil {
+		return disabledSpanReader{}
+	}
 	return store.reader
 }
 
 // SpanWriter returns the created logzio span writer
 func (store *Store) SpanWriter() spanstore.Writer {
+	if store.tenantWriter != nil {
+		return store.tenantWriter
+	}
+	if store.writer == nil {
+		return disabledSpanWriter{}
+	}
+	return store.writer
+}
+
+// LogzioSpanWriter returns the created logzio span writer, nil if the store is read-only
+func (store *Store) LogzioSpanWriter() *LogzioSpanWriter {
 	return store.writer
 }
 
 // DependencyReader return the created logzio dependency store
 func (store *Store) DependencyReader() dependencystore.Reader {
+	if store.tenantReader != nil {
+		return store.tenantReader
+	}
+	if store.reader == nil {
+		return disabledSpanReader{}
+	}
 	return store.reader
 }
+
+// ArchiveSpanReader returns the created logzio archive span reader
+func (store *Store) ArchiveSpanReader() spanstore.Reader {
+	if store.archiveReader == nil {
+		return disabledSpanReader{}
+	}
+	return store.archiveReader
+}
+
+// ArchiveSpanWriter returns the created logzio archive span writer
+func (store *Store) ArchiveSpanWriter() spanstore.Writer {
+	if store.archiveWriter == nil {
+		return disabledSpanWriter{}
+	}
+	return store.archiveWriter
+}
+
+// disabledSpanReader is the span and dependency reader of a write-only store
+type disabledSpanReader struct{}
+
+func (disabledSpanReader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
+	return nil, ErrReadDisabled
+}
+
+func (disabledSpanReader) GetServices(ctx context.Context) ([]string, error) {
+	return nil, ErrReadDisabled
+}
+
+func (disabledSpanReader) GetOperations(ctx context.Context, query spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
+	return nil, ErrReadDisabled
+}
+
+func (disabledSpanReader) FindTraces(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+	return nil, ErrReadDisabled
+}
+
+func (disabledSpanReader) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
+	return nil, ErrReadDisabled
+}
+
+func (disabledSpanReader) GetDependencies(ctx context.Context, endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
+	return nil, ErrReadDisabled
+}
+
+// disabledSpanWriter is the span writer of a read-only store
+type disabledSpanWriter struct{}
+
+func (disabledSpanWriter) WriteSpan(ctx context.Context, span *model.Span) error {
+	return ErrWriteDisabled
+}
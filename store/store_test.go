@@ -0,0 +1,51 @@
+package store
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadOnlyStore(tester *testing.T) {
+	readOnlyStore, err := NewLogzioStore(LogzioConfig{APIToken: testAPIToken}, logger)
+	assert.NoError(tester, err)
+	defer readOnlyStore.Close()
+
+	assert.Equal(tester, ErrWriteDisabled, readOnlyStore.SpanWriter().WriteSpan(context.Background(), &model.Span{}))
+	assert.Equal(tester, ErrWriteDisabled, readOnlyStore.ArchiveSpanWriter().WriteSpan(context.Background(), &model.Span{}))
+	assert.Nil(tester, readOnlyStore.LogzioSpanWriter())
+	assert.Equal(tester, readOnlyStore.reader, readOnlyStore.SpanReader())
+	assert.Contains(tester, readOnlyStore.Summary(), "read traces: enabled, write spans: disabled")
+}
+
+func TestWriteOnlyStore(tester *testing.T) {
+	writeOnlyStore, err := NewLogzioStore(LogzioConfig{AccountToken: testAccountToken, InMemoryQueue: true}, logger)
+	assert.NoError(tester, err)
+	defer writeOnlyStore.Close()
+
+	_, err = writeOnlyStore.SpanReader().GetTrace(context.Background(), model.NewTraceID(0, 1))
+	assert.Equal(tester, ErrReadDisabled, err)
+	_, err = writeOnlyStore.SpanReader().FindTraces(context.Background(), &spanstore.TraceQueryParameters{})
+	assert.Equal(tester, ErrReadDisabled, err)
+	_, err = writeOnlyStore.DependencyReader().GetDependencies(context.Background(), time.Now(), time.Hour)
+	assert.Equal(tester, ErrReadDisabled, err)
+	_, err = writeOnlyStore.ArchiveSpanReader().GetServices(context.Background())
+	assert.Equal(tester, ErrReadDisabled, err)
+	assert.Equal(tester, writeOnlyStore.writer, writeOnlyStore.SpanWriter())
+	assert.Contains(tester, writeOnlyStore.Summary(), "read traces: disabled, write spans: enabled")
+}
+
+func TestStoreWriterError(tester *testing.T) {
+	queueFile, err := ioutil.TempFile("", "logzio-queue")
+	assert.NoError(tester, err)
+	defer os.Remove(queueFile.Name())
+	// the disk queue can't be created under a regular file
+	_, err = NewLogzioStore(LogzioConfig{AccountToken: testAccountToken, APIToken: testAPIToken, CustomQueueDir: queueFile.Name()}, logger)
+	assert.Error(tester, err)
+}
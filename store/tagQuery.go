@@ -0,0 +1,214 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+)
+
+const (
+	tagEquals = iota
+	tagExists
+	tagWildcard
+	tagRange
+)
+
+const (
+	tagNegationPrefix = "!"
+	tagLogPrefix      = "log."
+	tagRangeSeparator = ".."
+	tagExistsValue    = "*"
+	tagWildcardSuffix = "*"
+	tagEscapedSuffix  = `\*`
+)
+
+// ErrInvalidTagQuery occurs when a tag of a trace query has an invalid operator or value
+var ErrInvalidTagQuery = errors.New("invalid tag query")
+
+// tagQuery is a tag condition of a trace query. Besides key=value, the tags of a query support the comparisons
+// key>value, key>=value, key<value and key<=value, key=from..to ranges of numbers or dates where either bound
+// may be left out, key=* which matches spans with the tag, wildcard values which end with *, and !key=value
+// negations. Other values are matched exactly, so URLs and paths with ? or .. aren't parsed, and a value which
+// ends with \* matches an exact value ending with *. Tags are matched in the span tags, the process tags and
+// the log fields, log.key=value matches only log fields
+type tagQuery struct {
+	key      string
+	value    string
+	operator int
+	negated  bool
+	log      bool
+	// gt, gte, lt and lte are the bounds of range queries
+	gt, gte, lt, lte string
+}
+
+// parseTagQuery parses a tag of a trace query. Comparisons may reach here in the key, as key>=500 is split
+// to the key "key>" and the value "500" and key>3 may be passed as a key without a value
+func parseTagQuery(key string, value string) (tagQuery, error) {
+	query := tagQuery{key: key, value: value, operator: tagEquals}
+	if strings.HasPrefix(query.key, tagNegationPrefix) {
+		query.negated = true
+		query.key = strings.TrimPrefix(query.key, tagNegationPrefix)
+	}
+	if strings.HasPrefix(query.key, tagLogPrefix) {
+		query.log = true
+		query.key = strings.TrimPrefix(query.key, tagLogPrefix)
+	}
+	if i := strings.IndexAny(query.key, "<>"); i >= 0 {
+		operator := query.key[i:]
+		query.key = query.key[:i]
+		if len(operator) == 1 {
+			operator += "="
+		} else if value == "" || value == "true" {
+			query.value = operator[1:]
+			operator = operator[:1]
+		} else {
+			return query, errors.Wrapf(ErrInvalidTagQuery, "can't parse %s=%s", key, value)
+		}
+		if query.log {
+			return query, errors.Wrapf(ErrInvalidTagQuery, "log field %s can't be compared, log field values are strings", query.key)
+		}
+		return query, query.parseComparison(key, operator)
+	}
+	if query.key == "" {
+		return query, errors.Wrapf(ErrInvalidTagQuery, "tag %q has no key", key)
+	}
+	switch {
+	case query.value == tagExistsValue:
+		query.operator = tagExists
+	case strings.HasSuffix(query.value, tagEscapedSuffix):
+		query.value = strings.TrimSuffix(query.value, tagEscapedSuffix) + tagWildcardSuffix
+	case strings.HasSuffix(query.value, tagWildcardSuffix):
+		query.operator = tagWildcard
+	default:
+		from, to, isRange := parseRangeBounds(query.value)
+		if !isRange {
+			break
+		}
+		if query.log {
+			return query, errors.Wrapf(ErrInvalidTagQuery, "log field %s can't be range queried, log field values are strings", query.key)
+		}
+		query.operator = tagRange
+		query.gte, query.lte = from, to
+	}
+	return query, nil
+}
+
+// parseRangeBounds splits a from..to range, it's a range only if its bounds are numbers or dates
+func parseRangeBounds(value string) (string, string, bool) {
+	bounds := strings.SplitN(value, tagRangeSeparator, 2)
+	if len(bounds) != 2 || (bounds[0] == "" && bounds[1] == "") {
+		return "", "", false
+	}
+	for _, bound := range bounds {
+		if bound != "" && !isRangeBound(bound) {
+			return "", "", false
+		}
+	}
+	return bounds[0], bounds[1], true
+}
+
+func isRangeBound(bound string) bool {
+	if _, err := strconv.ParseFloat(bound, 64); err == nil {
+		return true
+	}
+	if _, err := time.Parse(time.RFC3339, bound); err == nil {
+		return true
+	}
+	_, err := time.Parse("2006-01-02", bound)
+	return err == nil
+}
+
+func (query *tagQuery) parseComparison(key string, operator string) error {
+	if query.key == "" || query.value == "" {
+		return errors.Wrapf(ErrInvalidTagQuery, "can't parse comparison %s", key)
+	}
+	query.operator = tagRange
+	switch operator {
+	case ">":
+		query.gt = query.value
+	case ">=":
+		query.gte = query.value
+	case "<":
+		query.lt = query.value
+	case "<=":
+		query.lte = query.value
+	default:
+		return errors.Wrapf(ErrInvalidTagQuery, "unknown operator %s of tag %s", operator, query.key)
+	}
+	return nil
+}
+
+// objectQuery returns the query of the tag in an object of tags stored as fields
+func (query tagQuery) objectQuery(field string, key string) elastic.Query {
+	keyField := fmt.Sprintf("%s.%s", field, key)
+	switch query.operator {
+	case tagExists:
+		return elastic.NewExistsQuery(keyField)
+	case tagWildcard:
+		return elastic.NewWildcardQuery(keyField, query.wildcardPattern())
+	case tagRange:
+		return query.rangeQuery(keyField)
+	}
+	return buildObjectQuery(field, key, query.value)
+}
+
+// listQuery returns the query of the tag in a list of key value tags. The values in the lists are strings,
+// so they aren't range queried
+func (query tagQuery) listQuery(field string) elastic.Query {
+	keyQuery := elastic.NewTermQuery(fmt.Sprintf("%s.%s", field, tagKeyField), query.key)
+	valueField := fmt.Sprintf("%s.%s", field, tagValueField)
+	switch query.operator {
+	case tagExists:
+		return keyQuery
+	case tagWildcard:
+		return elastic.NewBoolQuery().Must(keyQuery, elastic.NewWildcardQuery(valueField, query.wildcardPattern()))
+	case tagRange:
+		return nil
+	}
+	return buildListQuery(field, query.key, query.value)
+}
+
+// logFieldsQuery returns the query of the tag in the fields of the span logs
+func (query tagQuery) logFieldsQuery(nested bool) elastic.Query {
+	if nested && query.operator == tagEquals {
+		return buildNestedQuery(logFieldsField, query.key, query.value)
+	}
+	listQuery := query.listQuery(logFieldsField)
+	if nested && listQuery != nil {
+		return elastic.NewNestedQuery(logFieldsField, listQuery)
+	}
+	return listQuery
+}
+
+// wildcardPattern escapes the ? of the value, only * is a wildcard in tag searches
+func (query tagQuery) wildcardPattern() string {
+	return strings.ReplaceAll(query.value, "?", `\?`)
+}
+
+func (query tagQuery) negate(tagBoolQuery elastic.Query) elastic.Query {
+	if query.negated {
+		return elastic.NewBoolQuery().MustNot(tagBoolQuery)
+	}
+	return tagBoolQuery
+}
+
+func (query tagQuery) rangeQuery(field string) elastic.Query {
+	rangeQuery := elastic.NewRangeQuery(field)
+	if query.gt != "" {
+		rangeQuery.Gt(query.gt)
+	}
+	if query.gte != "" {
+		rangeQuery.Gte(query.gte)
+	}
+	if query.lt != "" {
+		rangeQuery.Lt(query.lt)
+	}
+	if query.lte != "" {
+		rangeQuery.Lte(query.lte)
+	}
+	return rangeQuery
+}
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func tagQuerySource(tester *testing.T, query elastic.Query) string {
+	source, err := query.Source()
+	assert.NoError(tester, err)
+	sourceBytes, err := json.Marshal(source)
+	assert.NoError(tester, err)
+	return string(sourceBytes)
+}
+
+func TestParseTagQuery(tester *testing.T) {
+	tests := []struct {
+		key, value string
+		expected   tagQuery
+	}{
+		{"http.method", "GET", tagQuery{key: "http.method", value: "GET", operator: tagEquals}},
+		{"http.status_code>", "500", tagQuery{key: "http.status_code", value: "500", operator: tagRange, gte: "500"}},
+		{"retry.count>3", "true", tagQuery{key: "retry.count", value: "3", operator: tagRange, gt: "3"}},
+		{"latency<", "0.5", tagQuery{key: "latency", value: "0.5", operator: tagRange, lte: "0.5"}},
+		{"retry.count<3", "", tagQuery{key: "retry.count", value: "3", operator: tagRange, lt: "3"}},
+		{"http.status_code", "400..499", tagQuery{key: "http.status_code", value: "400..499", operator: tagRange, gte: "400", lte: "499"}},
+		{"http.status_code", "500..", tagQuery{key: "http.status_code", value: "500..", operator: tagRange, gte: "500"}},
+		{"db.instance", "*", tagQuery{key: "db.instance", value: "*", operator: tagExists}},
+		{"http.url", "https://api.*", tagQuery{key: "http.url", value: "https://api.*", operator: tagWildcard}},
+		{"!error", "true", tagQuery{key: "error", value: "true", operator: tagEquals, negated: true}},
+		{"!http.status_code>", "499", tagQuery{key: "http.status_code", value: "499", operator: tagRange, gte: "499", negated: true}},
+		{"log.event", "error", tagQuery{key: "event", value: "error", operator: tagEquals, log: true}},
+		{"!log.message", "*timeout*", tagQuery{key: "message", value: "*timeout*", operator: tagWildcard, log: true, negated: true}},
+		{"created", "2024-01-01..2024-02-01", tagQuery{key: "created", value: "2024-01-01..2024-02-01", operator: tagRange, gte: "2024-01-01", lte: "2024-02-01"}},
+		{"http.url", "/api/items?id=5", tagQuery{key: "http.url", value: "/api/items?id=5", operator: tagEquals}},
+		{"http.url", "https://api.example.com/items/*/details", tagQuery{key: "http.url", value: "https://api.example.com/items/*/details", operator: tagEquals}},
+		{"path", "../x", tagQuery{key: "path", value: "../x", operator: tagEquals}},
+		{"version", "1.2..beta", tagQuery{key: "version", value: "1.2..beta", operator: tagEquals}},
+		{"http.status_code", "..", tagQuery{key: "http.status_code", value: "..", operator: tagEquals}},
+		{"glob", `src/\*`, tagQuery{key: "glob", value: "src/*", operator: tagEquals}},
+	}
+	for _, test := range tests {
+		query, err := parseTagQuery(test.key, test.value)
+		assert.NoError(tester, err, test.key)
+		assert.Equal(tester, test.expected, query, test.key)
+	}
+
+	for key, value := range map[string]string{"log.retry>": "3", "log.attempt": "1..3", "!": "true", ">": "3", "retry.count>": "", "retry.count>3": "4", "": "value"} {
+		_, err := parseTagQuery(key, value)
+		assert.True(tester, errors.Is(err, ErrInvalidTagQuery), key)
+	}
+}
+
+func TestTagQueries(tester *testing.T) {
+	finder := NewTraceFinder(reader, LogzioConfig{})
+
+	tag, _ := parseTagQuery("http.status_code>", "500")
+	assert.Equal(tester, `{"bool":{"should":[{"range":{"JaegerTag.http@status_code":{"from":"500","include_lower":true,"include_upper":true,"to":null}}},`+
+		`{"range":{"process.tag.http@status_code":{"from":"500","include_lower":true,"include_upper":true,"to":null}}}]}}`,
+		tagQuerySource(tester, finder.buildTagQuery(tag)))
+
+	tag, _ = parseTagQuery("!db.instance", "*")
+	assert.Equal(tester, `{"bool":{"must_not":{"bool":{"should":[{"exists":{"field":"JaegerTag.db@instance"}},{"exists":{"field":"process.tag.db@instance"}},`+
+		`{"term":{"JaegerTags.key":"db.instance"}},{"term":{"process.tags.key":"db.instance"}},{"term":{"logs.fields.key":"db.instance"}}]}}}}`,
+		tagQuerySource(tester, finder.buildTagQuery(tag)))
+
+	tag, _ = parseTagQuery("http.url", "https://api.*")
+	source := tagQuerySource(tester, finder.buildTagQuery(tag))
+	assert.Contains(tester, source, `{"wildcard":{"JaegerTag.http@url":{"wildcard":"https://api.*"}}}`)
+	assert.Contains(tester, source, `{"wildcard":{"JaegerTags.value":{"wildcard":"https://api.*"}}}`)
+
+	tag, _ = parseTagQuery("http.url", "/api/items?id=*")
+	assert.Contains(tester, tagQuerySource(tester, finder.buildTagQuery(tag)), `{"wildcard":{"JaegerTag.http@url":{"wildcard":"/api/items\\?id=*"}}}`,
+		"only * should be a wildcard")
+
+	_, err := reader.FindTraceIDs(context.Background(), &spanstore.TraceQueryParameters{
+		ServiceName:  testService,
+		Tags:         map[string]string{"retry.count>3": "4"},
+		StartTimeMin: time.Now().Add(-time.Hour),
+		StartTimeMax: time.Now(),
+	})
+	assert.True(tester, errors.Is(err, ErrInvalidTagQuery))
+}
+
+func TestLogFieldTagQueries(tester *testing.T) {
+	finder := NewTraceFinder(reader, LogzioConfig{})
+	tag, _ := parseTagQuery("log.event", "error")
+	assert.Equal(tester, `{"bool":{"must":[{"term":{"logs.fields.key":"event"}},{"match":{"logs.fields.value":{"query":"error"}}}]}}`,
+		tagQuerySource(tester, finder.buildTagQuery(tag)))
+
+	tag, _ = parseTagQuery("error.kind", "Timeout")
+	assert.Contains(tester, tagQuerySource(tester, finder.buildTagQuery(tag)),
+		`{"bool":{"must":[{"term":{"logs.fields.key":"error.kind"}},{"match":{"logs.fields.value":{"query":"Timeout"}}}]}}`)
+
+	finder = NewTraceFinder(reader, LogzioConfig{LogFieldsNested: true})
+	tag, _ = parseTagQuery("log.event", "error")
+	assert.Equal(tester, `{"nested":{"path":"logs.fields","query":{"bool":{"must":[{"match":{"logs.fields.key":{"query":"event"}}},`+
+		`{"match":{"logs.fields.value":{"query":"error"}}}]}}}}`,
+		tagQuerySource(tester, finder.buildTagQuery(tag)))
+
+	tag, _ = parseTagQuery("!log.message", "*timeout*")
+	assert.Equal(tester, `{"bool":{"must_not":{"nested":{"path":"logs.fields","query":{"bool":{"must":[{"term":{"logs.fields.key":"message"}},`+
+		`{"wildcard":{"logs.fields.value":{"wildcard":"*timeout*"}}}]}}}}}}`,
+		tagQuerySource(tester, finder.buildTagQuery(tag)))
+}
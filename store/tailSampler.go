@@ -0,0 +1,256 @@
+package store
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/pkg/cache"
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// tail sampling decisions, also the values of the decision metric label
+	tailSamplingSampled = "sampled"
+	tailSamplingDropped = "dropped"
+	// how often buffered traces are checked for a decision
+	tailSamplingTickInterval = time.Second
+	// decisions are remembered for late spans for this many decision waits
+	tailSamplingDecisionTTLWaits = 5
+)
+
+// TailSamplingConfig configures buffering the spans of every trace, to decide whether to write the whole trace
+// once its spans arrived. A trace is written if any of the policies keeps it
+type TailSamplingConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// DecisionWait in seconds is how long the spans of a trace are buffered before the decision
+	DecisionWait int `yaml:"decisionWait"`
+	// MaxTraces bounds the buffered traces, the oldest trace is decided early when the buffer is full
+	MaxTraces int `yaml:"maxTraces"`
+	// MaxBytes bounds the size of the buffered spans, so a trace with a huge number of spans is decided early
+	MaxBytes int `yaml:"maxBytes"`
+	// KeepErrors keeps the traces with a span tagged with error=true
+	KeepErrors bool `yaml:"keepErrors"`
+	// MinRootDuration keeps the traces whose root span is longer, for example "2s"
+	MinRootDuration string `yaml:"minRootDuration"`
+	// Services keeps the traces with a span of one of the services
+	Services []string `yaml:"services"`
+	// BaselineTracesPerSecond keeps up to this rate of the traces which no other policy kept
+	BaselineTracesPerSecond float64 `yaml:"baselineTracesPerSecond"`
+}
+
+func (config TailSamplingConfig) minRootDuration() (time.Duration, error) {
+	if config.MinRootDuration == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(config.MinRootDuration)
+	return duration, errors.Wrap(err, "invalid tail sampling minRootDuration")
+}
+
+// bufferedTrace holds the spans of a trace until the sampling decision
+type bufferedTrace struct {
+	traceID      model.TraceID
+	firstSeen    time.Time
+	spans        [][]byte
+	bytes        int
+	hasError     bool
+	rootDuration time.Duration
+	services     map[string]bool
+}
+
+// decidedTrace is a trace removed from the buffer with its decision, its spans are sent outside the lock
+type decidedTrace struct {
+	trace   *bufferedTrace
+	sampled bool
+}
+
+// tailSampler buffers spans by trace id and sends the spans of the sampled traces
+type tailSampler struct {
+	logger          hclog.Logger
+	send            func([]byte) error
+	decisionWait    time.Duration
+	maxTraces       int
+	keepErrors      bool
+	minRootDuration time.Duration
+	services        map[string]bool
+	baseline        *rate.Limiter
+	lock            sync.Mutex
+	traces          map[model.TraceID]*list.Element
+	// order holds the buffered traces from the oldest to the newest
+	order     *list.List
+	decisions cache.Cache
+	stop      chan struct{}
+	done      chan struct{}
+	// maxBytes bounds bufferedBytes, the size of the buffered spans
+	maxBytes      int
+	bufferedBytes int
+}
+
+func newTailSampler(config TailSamplingConfig, decisionWait time.Duration, maxTraces int, maxBytes int, send func([]byte) error, logger hclog.Logger) (*tailSampler, error) {
+	minRootDuration, err := config.minRootDuration()
+	if err != nil {
+		return nil, err
+	}
+	services := make(map[string]bool)
+	for _, service := range config.Services {
+		services[service] = true
+	}
+	sampler := &tailSampler{
+		logger:          logger,
+		send:            send,
+		decisionWait:    decisionWait,
+		maxTraces:       maxTraces,
+		keepErrors:      config.KeepErrors,
+		minRootDuration: minRootDuration,
+		services:        services,
+		traces:          make(map[model.TraceID]*list.Element),
+		order:           list.New(),
+		decisions: cache.NewLRUWithOptions(
+			maxTraces,
+			&cache.Options{
+				TTL: tailSamplingDecisionTTLWaits * decisionWait,
+			},
+		),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		maxBytes: maxBytes,
+	}
+	if config.BaselineTracesPerSecond > 0 {
+		burst := int(config.BaselineTracesPerSecond)
+		if burst < 1 {
+			burst = 1
+		}
+		sampler.baseline = rate.NewLimiter(rate.Limit(config.BaselineTracesPerSecond), burst)
+	}
+	return sampler, nil
+}
+
+func (sampler *tailSampler) start() {
+	go func() {
+		defer close(sampler.done)
+		ticker := time.NewTicker(tailSamplingTickInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sampler.decideExpired(time.Now().Add(-sampler.decisionWait))
+			case <-sampler.stop:
+				sampler.decideExpired(time.Now())
+				return
+			}
+		}
+	}()
+}
+
+// close stops the decision loop after deciding all the buffered traces
+func (sampler *tailSampler) close() {
+	close(sampler.stop)
+	<-sampler.done
+}
+
+// add buffers the span until its trace is decided, spans which arrive after the decision follow it.
+// Decisions are recorded under the lock before their trace leaves the buffer, so a span always finds either
+// its buffered trace or the decision of its trace
+func (sampler *tailSampler) add(span *model.Span, spanBytes []byte) {
+	sampler.lock.Lock()
+	if sampled, ok := sampler.decisions.Get(span.TraceID.String()).(bool); ok {
+		sampler.lock.Unlock()
+		tailSamplingLateSpansTotal.Inc()
+		if sampled {
+			sampler.sendSpans([][]byte{spanBytes})
+		}
+		return
+	}
+	element, ok := sampler.traces[span.TraceID]
+	if !ok {
+		element = sampler.order.PushBack(&bufferedTrace{
+			traceID:   span.TraceID,
+			firstSeen: time.Now(),
+			services:  make(map[string]bool),
+		})
+		sampler.traces[span.TraceID] = element
+	}
+	trace := element.Value.(*bufferedTrace)
+	trace.spans = append(trace.spans, spanBytes)
+	trace.bytes += len(spanBytes)
+	sampler.bufferedBytes += len(spanBytes)
+	trace.hasError = trace.hasError || isErrorSpan(span)
+	trace.services[span.Process.ServiceName] = true
+	if len(span.References) == 0 {
+		trace.rootDuration = span.Duration
+	}
+	var evicted []decidedTrace
+	for sampler.order.Len() > sampler.maxTraces || (sampler.maxBytes > 0 && sampler.bufferedBytes > sampler.maxBytes) {
+		evicted = append(evicted, sampler.decideOldest())
+	}
+	tailSamplingBufferedTraces.Set(float64(sampler.order.Len()))
+	sampler.lock.Unlock()
+
+	for _, decided := range evicted {
+		tailSamplingEvictedTracesTotal.Inc()
+		sampler.finish(decided)
+	}
+}
+
+// decideOldest decides the oldest trace and removes it from the buffer, it must be called with the lock held
+func (sampler *tailSampler) decideOldest() decidedTrace {
+	trace := sampler.order.Front().Value.(*bufferedTrace)
+	sampled := sampler.isSampled(trace)
+	sampler.decisions.Put(trace.traceID.String(), sampled)
+	sampler.order.Remove(sampler.order.Front())
+	delete(sampler.traces, trace.traceID)
+	sampler.bufferedBytes -= trace.bytes
+	return decidedTrace{trace: trace, sampled: sampled}
+}
+
+// decideExpired decides the traces which were first seen before the deadline
+func (sampler *tailSampler) decideExpired(deadline time.Time) {
+	var expired []decidedTrace
+	sampler.lock.Lock()
+	for sampler.order.Len() > 0 && !sampler.order.Front().Value.(*bufferedTrace).firstSeen.After(deadline) {
+		expired = append(expired, sampler.decideOldest())
+	}
+	tailSamplingBufferedTraces.Set(float64(sampler.order.Len()))
+	sampler.lock.Unlock()
+
+	for _, decided := range expired {
+		sampler.finish(decided)
+	}
+}
+
+// finish sends the spans of a decided trace if it's sampled
+func (sampler *tailSampler) finish(decided decidedTrace) {
+	if decided.sampled {
+		tailSamplingTracesTotal.WithLabelValues(tailSamplingSampled).Inc()
+		sampler.sendSpans(decided.trace.spans)
+	} else {
+		tailSamplingTracesTotal.WithLabelValues(tailSamplingDropped).Inc()
+	}
+}
+
+func (sampler *tailSampler) isSampled(trace *bufferedTrace) bool {
+	if sampler.keepErrors && trace.hasError {
+		return true
+	}
+	if sampler.minRootDuration > 0 && trace.rootDuration > sampler.minRootDuration {
+		return true
+	}
+	for service := range trace.services {
+		if sampler.services[service] {
+			return true
+		}
+	}
+	return sampler.baseline != nil && sampler.baseline.Allow()
+}
+
+func (sampler *tailSampler) sendSpans(spans [][]byte) {
+	for _, spanBytes := range spans {
+		if err := sampler.send(spanBytes); err != nil {
+			sampler.logger.Warn(fmt.Sprintf("can't send tail sampled span: %s", err.Error()))
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package store
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type sentSpans struct {
+	lock  sync.Mutex
+	spans []string
+}
+
+func (sent *sentSpans) send(spanBytes []byte) error {
+	sent.lock.Lock()
+	defer sent.lock.Unlock()
+	sent.spans = append(sent.spans, string(spanBytes))
+	return nil
+}
+
+func (sent *sentSpans) get() []string {
+	sent.lock.Lock()
+	defer sent.lock.Unlock()
+	return append([]string(nil), sent.spans...)
+}
+
+func childTestSpan(traceID uint64, service string, duration time.Duration, tags ...model.KeyValue) *model.Span {
+	span := filterTestSpan(traceID, service, "child", duration, tags...)
+	span.References = []model.SpanRef{model.NewChildOfRef(span.TraceID, model.NewSpanID(1))}
+	return span
+}
+
+func newTestTailSampler(tester *testing.T, config TailSamplingConfig, maxTraces int) (*tailSampler, *sentSpans) {
+	sent := &sentSpans{}
+	sampler, err := newTailSampler(config, time.Minute, maxTraces, 0, sent.send, hclog.NewNullLogger())
+	assert.NoError(tester, err)
+	return sampler, sent
+}
+
+func TestTailSamplerPolicies(tester *testing.T) {
+	sampler, sent := newTestTailSampler(tester, TailSamplingConfig{
+		KeepErrors:      true,
+		MinRootDuration: "2s",
+		Services:        []string{"payments"},
+	}, 100)
+	dropped := testutil.ToFloat64(tailSamplingTracesTotal.WithLabelValues(tailSamplingDropped))
+
+	sampler.add(filterTestSpan(1, "api", "root", time.Second), []byte("error-root"))
+	sampler.add(childTestSpan(1, "db", time.Millisecond, model.Bool("error", true)), []byte("error-child"))
+	sampler.add(filterTestSpan(2, "api", "root", 3*time.Second), []byte("slow-root"))
+	sampler.add(childTestSpan(2, "db", 5*time.Second), []byte("slow-child"))
+	sampler.add(filterTestSpan(3, "api", "root", time.Second), []byte("payments-root"))
+	sampler.add(childTestSpan(3, "payments", time.Millisecond), []byte("payments-child"))
+	sampler.add(filterTestSpan(4, "api", "root", time.Second), []byte("plain-root"))
+	sampler.add(childTestSpan(4, "db", 5*time.Second), []byte("plain-child"))
+	assert.Empty(tester, sent.get(), "spans should be buffered until the decision")
+
+	sampler.decideExpired(time.Now())
+	assert.Equal(tester, []string{"error-root", "error-child", "slow-root", "slow-child", "payments-root", "payments-child"}, sent.get())
+	assert.Equal(tester, dropped+1, testutil.ToFloat64(tailSamplingTracesTotal.WithLabelValues(tailSamplingDropped)))
+	assert.Equal(tester, 0, sampler.order.Len())
+}
+
+func TestTailSamplerBaselineRate(tester *testing.T) {
+	sampler, sent := newTestTailSampler(tester, TailSamplingConfig{BaselineTracesPerSecond: 1}, 100)
+	for traceID := uint64(1); traceID <= 10; traceID++ {
+		sampler.add(filterTestSpan(traceID, "api", "root", time.Second), []byte("root"))
+	}
+	sampler.decideExpired(time.Now())
+	assert.Len(tester, sent.get(), 1)
+}
+
+func TestTailSamplerEvictsOldestTrace(tester *testing.T) {
+	sampler, sent := newTestTailSampler(tester, TailSamplingConfig{Services: []string{"api"}}, 2)
+	evicted := testutil.ToFloat64(tailSamplingEvictedTracesTotal)
+
+	sampler.add(filterTestSpan(1, "api", "root", time.Second), []byte("first"))
+	sampler.add(filterTestSpan(2, "api", "root", time.Second), []byte("second"))
+	sampler.add(filterTestSpan(3, "api", "root", time.Second), []byte("third"))
+
+	assert.Equal(tester, []string{"first"}, sent.get())
+	assert.Equal(tester, evicted+1, testutil.ToFloat64(tailSamplingEvictedTracesTotal))
+	assert.Equal(tester, float64(2), testutil.ToFloat64(tailSamplingBufferedTraces))
+}
+
+func TestTailSamplerEvictsOverMaxBytes(tester *testing.T) {
+	sent := &sentSpans{}
+	sampler, err := newTailSampler(TailSamplingConfig{Services: []string{"api"}}, time.Minute, 100, 10, sent.send, hclog.NewNullLogger())
+	assert.NoError(tester, err)
+
+	sampler.add(filterTestSpan(1, "api", "root", time.Second), []byte("first"))
+	sampler.add(childTestSpan(1, "api", time.Millisecond), []byte("child"))
+	assert.Empty(tester, sent.get())
+	sampler.add(filterTestSpan(2, "api", "root", time.Second), []byte("second"))
+
+	assert.Equal(tester, []string{"first", "child"}, sent.get(), "the oldest trace should be decided when the buffered bytes exceed the limit")
+	assert.Equal(tester, 1, sampler.order.Len())
+	assert.Equal(tester, len("second"), sampler.bufferedBytes)
+
+	sampler.add(childTestSpan(1, "api", time.Millisecond), []byte("late"))
+	assert.Equal(tester, []string{"first", "child", "late"}, sent.get(), "spans of a decided trace should follow its decision")
+}
+
+func TestTailSamplerLateSpansFollowDecision(tester *testing.T) {
+	sampler, sent := newTestTailSampler(tester, TailSamplingConfig{KeepErrors: true}, 100)
+	sampler.add(filterTestSpan(1, "api", "root", time.Second, model.Bool("error", true)), []byte("kept-root"))
+	sampler.add(filterTestSpan(2, "api", "root", time.Second), []byte("dropped-root"))
+	sampler.decideExpired(time.Now())
+
+	sampler.add(childTestSpan(1, "db", time.Millisecond), []byte("kept-late"))
+	sampler.add(childTestSpan(2, "db", time.Millisecond), []byte("dropped-late"))
+	assert.Equal(tester, []string{"kept-root", "kept-late"}, sent.get())
+	assert.Equal(tester, 0, sampler.order.Len())
+}
+
+func TestTailSamplerCloseDecidesBufferedTraces(tester *testing.T) {
+	sampler, sent := newTestTailSampler(tester, TailSamplingConfig{Services: []string{"api"}}, 100)
+	sampler.start()
+	sampler.add(filterTestSpan(1, "api", "root", time.Second), []byte("root"))
+	sampler.close()
+	assert.Equal(tester, []string{"root"}, sent.get())
+}
+
+func TestInvalidTailSamplingConfig(tester *testing.T) {
+	_, err := newTailSampler(TailSamplingConfig{MinRootDuration: "long"}, time.Minute, 100, 0, nil, hclog.NewNullLogger())
+	assert.Error(tester, err)
+}
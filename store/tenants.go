@@ -0,0 +1,263 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// defaultTenantHeader is the grpc metadata key jaeger propagates the tenant with
+	defaultTenantHeader = "x-tenant"
+)
+
+var (
+	// ErrUnknownTenant is returned for the queries of a tenant which isn't configured
+	ErrUnknownTenant = errors.New("unknown tenant")
+
+	tenantNameRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// Tenant is a logz.io account of a team which shares the collector and query deployments.
+// A span belongs to the tenant named by the tenant header of its request, or to the first tenant whose rules match it.
+// A rule matches if all of its set conditions match, a tenant without rules is matched only by the tenant header
+type Tenant struct {
+	Name         string `yaml:"name" json:"name"`
+	AccountToken string `yaml:"accountToken" json:"accountToken"`
+	APIToken     string `yaml:"apiToken" json:"apiToken"`
+	// APIURL is the search api of the tenant account, the api of the configured region by default
+	APIURL string `yaml:"apiUrl" json:"apiUrl"`
+	// Services and ServiceRegex match the spans of the tenant services
+	Services     []string `yaml:"services" json:"services"`
+	ServiceRegex string   `yaml:"serviceRegex" json:"serviceRegex"`
+	// ProcessTags maps process tag keys to regexes their values must match
+	ProcessTags map[string]string `yaml:"processTags" json:"processTags"`
+}
+
+type compiledTenant struct {
+	Tenant
+	services     map[string]bool
+	serviceRegex *regexp.Regexp
+	processTags  map[string]*regexp.Regexp
+}
+
+// tenantRouter finds the tenant of spans and queries, an empty tenant name is the default account
+type tenantRouter struct {
+	header  string
+	tenants []*compiledTenant
+	byName  map[string]*compiledTenant
+}
+
+func newTenantRouter(header string, tenants []Tenant) (*tenantRouter, error) {
+	if header == "" {
+		header = defaultTenantHeader
+	}
+	router := &tenantRouter{header: strings.ToLower(header), byName: make(map[string]*compiledTenant)}
+	for i, tenant := range tenants {
+		compiledTenant, err := compileTenant(tenant)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid tenant %d", i+1)
+		}
+		if router.byName[tenant.Name] != nil {
+			return nil, fmt.Errorf("duplicate tenant %s", tenant.Name)
+		}
+		router.tenants = append(router.tenants, compiledTenant)
+		router.byName[tenant.Name] = compiledTenant
+	}
+	return router, nil
+}
+
+func compileTenant(tenant Tenant) (*compiledTenant, error) {
+	if !tenantNameRegex.MatchString(tenant.Name) {
+		return nil, fmt.Errorf("tenant name %q must consist of letters, digits, - and _", tenant.Name)
+	}
+	if tenant.AccountToken == "" && tenant.APIToken == "" {
+		return nil, fmt.Errorf("tenant %s requires an account token or an api token", tenant.Name)
+	}
+	compiledTenant := &compiledTenant{
+		Tenant:      tenant,
+		services:    make(map[string]bool),
+		processTags: make(map[string]*regexp.Regexp),
+	}
+	for _, service := range tenant.Services {
+		compiledTenant.services[service] = true
+	}
+	var err error
+	if tenant.ServiceRegex != "" {
+		if compiledTenant.serviceRegex, err = regexp.Compile(tenant.ServiceRegex); err != nil {
+			return nil, errors.Wrap(err, "invalid serviceRegex")
+		}
+	}
+	for key, valueRegex := range tenant.ProcessTags {
+		if compiledTenant.processTags[key], err = regexp.Compile(valueRegex); err != nil {
+			return nil, errors.Wrapf(err, "invalid regex of process tag %s", key)
+		}
+	}
+	return compiledTenant, nil
+}
+
+func (tenant *compiledTenant) hasServiceRule() bool {
+	return len(tenant.services) > 0 || tenant.serviceRegex != nil
+}
+
+func (tenant *compiledTenant) matchesService(service string) bool {
+	if len(tenant.services) > 0 && !tenant.services[service] {
+		return false
+	}
+	return tenant.serviceRegex == nil || tenant.serviceRegex.MatchString(service)
+}
+
+func (tenant *compiledTenant) matchesSpan(span *model.Span) bool {
+	if !tenant.hasServiceRule() && len(tenant.processTags) == 0 {
+		return false
+	}
+	process := span.GetProcess()
+	if !tenant.matchesService(process.GetServiceName()) {
+		return false
+	}
+	for key, valueRegex := range tenant.processTags {
+		tag, found := model.KeyValues(process.GetTags()).FindByKey(key)
+		if !found || !valueRegex.MatchString(tag.AsString()) {
+			return false
+		}
+	}
+	return true
+}
+
+// headerTenant returns the tenant header of the incoming grpc request, if it has one
+func (router *tenantRouter) headerTenant(ctx context.Context) (string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+	values := md.Get(router.header)
+	if len(values) == 0 || values[0] == "" {
+		return "", false
+	}
+	return values[0], true
+}
+
+// spanTenant returns the name of the tenant the span is written to. A span whose tenant header names an unknown
+// tenant has no tenant, it isn't matched by the conditions of the other tenants so it can't reach their accounts
+func (router *tenantRouter) spanTenant(ctx context.Context, span *model.Span) string {
+	if name, ok := router.headerTenant(ctx); ok {
+		if router.byName[name] != nil {
+			return name
+		}
+		return ""
+	}
+	for _, tenant := range router.tenants {
+		if tenant.matchesSpan(span) {
+			return tenant.Name
+		}
+	}
+	return ""
+}
+
+// tenantSpanWriter routes spans to the writers of their tenants, spans of no tenant go to the default writer
+type tenantSpanWriter struct {
+	router        *tenantRouter
+	defaultWriter *LogzioSpanWriter
+	writers       map[string]*LogzioSpanWriter
+}
+
+// WriteSpan writes the span to the account of its tenant, it's dropped if it has no tenant and there's no default account
+func (tenantWriter *tenantSpanWriter) WriteSpan(ctx context.Context, span *model.Span) error {
+	writer := tenantWriter.defaultWriter
+	if name := tenantWriter.router.spanTenant(ctx, span); name != "" {
+		writer = tenantWriter.writers[name]
+	}
+	if writer == nil {
+		spansUnroutedTotal.Inc()
+		return nil
+	}
+	return writer.WriteSpan(ctx, span)
+}
+
+func (tenantWriter *tenantSpanWriter) close() {
+	for _, writer := range tenantWriter.writers {
+		writer.Close()
+	}
+}
+
+// tenantSpanReader searches the account of the tenant named in the tenant header of each query, queries without
+// the header search only the default account, so no query reads the data of another tenant
+type tenantSpanReader struct {
+	router        *tenantRouter
+	defaultReader *LogzioSpanReader
+	readers       map[string]*LogzioSpanReader
+}
+
+// queryReader returns the reader of the tenant named by the request, or the reader of the default account
+func (tenantReader *tenantSpanReader) queryReader(ctx context.Context) (*LogzioSpanReader, error) {
+	name, ok := tenantReader.router.headerTenant(ctx)
+	if !ok {
+		if tenantReader.defaultReader == nil {
+			return nil, errors.Wrap(ErrReadDisabled, "can't query without a tenant")
+		}
+		return tenantReader.defaultReader, nil
+	}
+	if tenantReader.router.byName[name] == nil {
+		return nil, errors.Wrapf(ErrUnknownTenant, "can't query tenant %s", name)
+	}
+	reader := tenantReader.readers[name]
+	if reader == nil {
+		return nil, errors.Wrapf(ErrReadDisabled, "can't query tenant %s", name)
+	}
+	return reader, nil
+}
+
+func (tenantReader *tenantSpanReader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
+	reader, err := tenantReader.queryReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return reader.GetTrace(ctx, traceID)
+}
+
+func (tenantReader *tenantSpanReader) GetServices(ctx context.Context) ([]string, error) {
+	reader, err := tenantReader.queryReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return reader.GetServices(ctx)
+}
+
+func (tenantReader *tenantSpanReader) GetOperations(ctx context.Context, query spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
+	reader, err := tenantReader.queryReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return reader.GetOperations(ctx, query)
+}
+
+func (tenantReader *tenantSpanReader) FindTraces(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+	reader, err := tenantReader.queryReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return reader.FindTraces(ctx, query)
+}
+
+func (tenantReader *tenantSpanReader) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
+	reader, err := tenantReader.queryReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return reader.FindTraceIDs(ctx, query)
+}
+
+func (tenantReader *tenantSpanReader) GetDependencies(ctx context.Context, endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
+	reader, err := tenantReader.queryReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return reader.GetDependencies(ctx, endTs, lookback)
+}
@@ -0,0 +1,148 @@
+package store
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/metadata"
+)
+
+var testTenants = []Tenant{
+	{Name: "payments", AccountToken: "paymentsAccountToken", APIToken: "paymentsAPIToken", ServiceRegex: "^payments-"},
+	{Name: "search", AccountToken: "searchAccountToken", APIToken: "searchAPIToken", ProcessTags: map[string]string{"team": "^search$"}},
+	{Name: "mobile", APIToken: "mobileAPIToken"},
+}
+
+func tenantContext(tenant string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(defaultTenantHeader, tenant))
+}
+
+func TestTenantRouter(tester *testing.T) {
+	router, err := newTenantRouter("", testTenants)
+	assert.NoError(tester, err)
+	searchSpan := filterTestSpan(1, "indexer", "index", time.Second)
+	searchSpan.Process.Tags = []model.KeyValue{model.String("team", "search")}
+
+	assert.Equal(tester, "payments", router.spanTenant(context.Background(), filterTestSpan(1, "payments-api", "charge", time.Second)))
+	assert.Equal(tester, "search", router.spanTenant(context.Background(), searchSpan))
+	assert.Equal(tester, "", router.spanTenant(context.Background(), filterTestSpan(1, "frontend", "render", time.Second)))
+	assert.Equal(tester, "mobile", router.spanTenant(tenantContext("mobile"), filterTestSpan(1, "payments-api", "charge", time.Second)))
+	assert.Equal(tester, "", router.spanTenant(tenantContext("unknown"), filterTestSpan(1, "payments-api", "charge", time.Second)),
+		"spans of an unknown tenant should not be routed to the accounts of other tenants")
+
+}
+
+func TestInvalidTenants(tester *testing.T) {
+	for _, tenants := range [][]Tenant{
+		{{Name: "", AccountToken: "token"}},
+		{{Name: "payments/prod", AccountToken: "token"}},
+		{{Name: "payments"}},
+		{{Name: "payments", AccountToken: "token", ServiceRegex: "("}},
+		{{Name: "payments", AccountToken: "token"}, {Name: "payments", APIToken: "token"}},
+	} {
+		_, err := newTenantRouter("", tenants)
+		assert.Error(tester, err, tenants)
+	}
+}
+
+func TestTenantReaderSelectsAPIToken(tester *testing.T) {
+	var apiTokens []string
+	tenantServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		apiTokens = append(apiTokens, req.Header.Get(apiTokenHeader))
+		_, _ = rw.Write([]byte(`{"responses":[{"hits":{"hits":[]}}]}`))
+	}))
+	defer tenantServer.Close()
+	tenantStore, err := NewLogzioStore(LogzioConfig{APIToken: testAPIToken, CustomAPIURL: tenantServer.URL, Tenants: testTenants}, logger)
+	assert.NoError(tester, err)
+	defer tenantStore.Close()
+	query := &spanstore.TraceQueryParameters{StartTimeMin: time.Now().Add(-time.Hour), StartTimeMax: time.Now()}
+
+	query.ServiceName = "payments-api"
+	_, _ = tenantStore.SpanReader().FindTraceIDs(context.Background(), query)
+	assert.Equal(tester, []string{testAPIToken}, apiTokens, "queries without a tenant header should search only the default account")
+
+	apiTokens = nil
+	_, _ = tenantStore.SpanReader().FindTraceIDs(tenantContext("payments"), query)
+	assert.Equal(tester, []string{"paymentsAPIToken"}, apiTokens)
+
+	apiTokens = nil
+	_, _ = tenantStore.SpanReader().GetServices(tenantContext("mobile"))
+	assert.Equal(tester, []string{"mobileAPIToken"}, apiTokens)
+
+	apiTokens = nil
+	_, _ = tenantStore.SpanReader().GetServices(context.Background())
+	_, _ = tenantStore.DependencyReader().GetDependencies(context.Background(), time.Now(), time.Hour)
+	for _, apiToken := range apiTokens {
+		assert.Equal(tester, testAPIToken, apiToken)
+	}
+}
+
+func TestTenantReaderWithoutDefaultAccount(tester *testing.T) {
+	tenantStore, err := NewLogzioStore(LogzioConfig{Tenants: testTenants, InMemoryQueue: true}, logger)
+	assert.NoError(tester, err)
+	defer tenantStore.Close()
+
+	_, err = tenantStore.SpanReader().GetServices(context.Background())
+	assert.True(tester, errors.Is(err, ErrReadDisabled))
+	_, err = tenantStore.SpanReader().GetTrace(context.Background(), model.NewTraceID(0, 1))
+	assert.True(tester, errors.Is(err, ErrReadDisabled))
+}
+
+func TestTenantHeaderScopesQueries(tester *testing.T) {
+	var apiTokens []string
+	tenantServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		apiTokens = append(apiTokens, req.Header.Get(apiTokenHeader))
+		_, _ = rw.Write([]byte(`{"responses":[{"hits":{"hits":[]}}]}`))
+	}))
+	defer tenantServer.Close()
+	tenants := []Tenant{
+		{Name: "payments", APIToken: "paymentsAPIToken", APIURL: tenantServer.URL, ServiceRegex: "^payments-"},
+		{Name: "writers", AccountToken: "writersAccountToken"},
+	}
+	tenantStore, err := NewLogzioStore(LogzioConfig{APIToken: testAPIToken, CustomAPIURL: "http://localhost:1", Tenants: tenants, InMemoryQueue: true}, logger)
+	assert.NoError(tester, err)
+	defer tenantStore.Close()
+	reader := tenantStore.SpanReader()
+
+	_, err = reader.GetTrace(tenantContext("payments"), model.NewTraceID(0, 1))
+	assert.Equal(tester, spanstore.ErrTraceNotFound, err)
+	_, _ = reader.GetOperations(tenantContext("payments"), spanstore.OperationQueryParameters{ServiceName: "frontend"})
+	assert.NotEmpty(tester, apiTokens)
+	for _, apiToken := range apiTokens {
+		assert.Equal(tester, "paymentsAPIToken", apiToken)
+	}
+
+	_, err = reader.GetServices(tenantContext("unknown"))
+	assert.True(tester, errors.Is(err, ErrUnknownTenant))
+	assert.EqualError(tester, err, "can't query tenant unknown: unknown tenant")
+	_, err = reader.FindTraces(tenantContext("unknown"), &spanstore.TraceQueryParameters{ServiceName: "payments-api"})
+	assert.True(tester, errors.Is(err, ErrUnknownTenant))
+	_, err = reader.GetTrace(tenantContext("writers"), model.NewTraceID(0, 1))
+	assert.True(tester, errors.Is(err, ErrReadDisabled))
+}
+
+func TestTenantWriters(tester *testing.T) {
+	tenantStore, err := NewLogzioStore(LogzioConfig{Tenants: testTenants, InMemoryQueue: true}, logger)
+	assert.NoError(tester, err)
+	defer tenantStore.Close()
+
+	assert.Len(tester, tenantStore.tenantWriter.writers, 2)
+	assert.Equal(tester, "paymentsAccountToken", tenantStore.tenantWriter.writers["payments"].accountToken)
+	assert.Nil(tester, tenantStore.tenantWriter.defaultWriter)
+	assert.Contains(tester, tenantStore.Summary(), "tenants: 3")
+	assert.NotEqual(tester, tenantStore.tenantWriter.writers["payments"].sender.queueDir, tenantStore.tenantWriter.writers["search"].sender.queueDir)
+
+	unrouted := testutil.ToFloat64(spansUnroutedTotal)
+	assert.NoError(tester, tenantStore.SpanWriter().WriteSpan(context.Background(), filterTestSpan(1, "frontend", "render", time.Second)))
+	assert.Equal(tester, unrouted+1, testutil.ToFloat64(spansUnroutedTotal))
+	assert.NoError(tester, tenantStore.SpanWriter().WriteSpan(tenantContext("unknown"), filterTestSpan(1, "payments-api", "charge", time.Second)))
+	assert.Equal(tester, unrouted+2, testutil.ToFloat64(spansUnroutedTotal), "spans of an unknown tenant should not be written to a matching tenant")
+}
@@ -4,13 +4,13 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"sync"
 	"time"
 
 	"github.com/jaegertracing/jaeger/storage/spanstore"
 	"github.com/logzio/jaeger-logzio/store/objects"
 	"github.com/opentracing/opentracing-go"
 
-	"github.com/avast/retry-go"
 	"github.com/hashicorp/go-hclog"
 	"github.com/jaegertracing/jaeger/model"
 	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
@@ -19,8 +19,7 @@ import (
 )
 
 const (
-	maxRetryAttempts = 4
-	maxBulkSize      = 100
+	maxBulkSize = 100
 )
 
 // TraceFinder object builds search request from traceIDs and parse the result to traces
@@ -29,28 +28,44 @@ type TraceFinder struct {
 	sourceFn      sourceFn
 	spanConverter dbmodel.ToDomain
 	reader        *LogzioSpanReader
+	// fetchConcurrency is the number of bulks fetched in parallel
+	fetchConcurrency int
+	// queryTimeout limits the total time of fetching the traces of a single query
+	queryTimeout time.Duration
+	// logFieldsNested searches the log fields with nested queries
+	logFieldsNested bool
+	// traceLevelSearch and traceDuration decide whether the criteria of trace searches are matched by traces or by single spans
+	traceLevelSearch bool
+	traceDuration    string
 }
 
 // NewTraceFinder creates trace finder object
-func NewTraceFinder(reader *LogzioSpanReader) TraceFinder {
+func NewTraceFinder(reader *LogzioSpanReader, config LogzioConfig) TraceFinder {
 	return TraceFinder{
-		logger:        reader.logger,
-		sourceFn:      getSourceFn(),
-		reader:        reader,
-		spanConverter: dbmodel.NewToDomain(objects.TagDotReplacementCharacter),
+		logger:           reader.logger,
+		sourceFn:         getSourceFn(),
+		reader:           reader,
+		spanConverter:    dbmodel.NewToDomain(objects.TagDotReplacementCharacter),
+		fetchConcurrency: config.fetchConcurrency(),
+		queryTimeout:     config.queryTimeout(),
+		logFieldsNested:  config.LogFieldsNested,
+		traceLevelSearch: config.TraceLevelSearch,
+		traceDuration:    config.traceDuration(),
 	}
 }
 
-func (finder *TraceFinder) traceIDsMultiSearchRequestBody(traceIDs []model.TraceID, nextTime uint64, endTime time.Time, searchAfterTime map[model.TraceID]uint64) string {
+func (finder *TraceFinder) traceIDsMultiSearchRequestBody(traceIDs []model.TraceID, startTime uint64, endTime time.Time, searchAfterTime map[model.TraceID]uint64) string {
 	multiSearchBody := ""
 	for _, traceID := range traceIDs {
 		finder.logger.Debug(fmt.Sprintf("creating request for trace %s", traceID.String()))
-		traceIDTerm := elastic.NewTermQuery(traceIDField, traceID.String())
-		rangeQuery := elastic.NewRangeQuery(startTimeField).Gte(nextTime).Lte(model.TimeAsEpochMicroseconds(endTime))
-		query := elastic.NewBoolQuery().Filter(traceIDTerm, rangeQuery)
+		nextTime := startTime
 		if val, ok := searchAfterTime[traceID]; ok {
 			nextTime = val
 		}
+		traceIDTerm := elastic.NewTermQuery(traceIDField, traceID.String())
+		rangeQuery := elastic.NewRangeQuery(startTimeField).Gte(nextTime).Lte(model.TimeAsEpochMicroseconds(endTime))
+		typeTerm := elastic.NewTermQuery(typeField, finder.reader.spanType)
+		query := elastic.NewBoolQuery().Filter(traceIDTerm, rangeQuery, typeTerm).Filter(finder.reader.searchFields...)
 		source := finder.sourceFn(query, nextTime)
 		searchRequest := elastic.NewSearchRequest().
 			IgnoreUnavailable(true).
@@ -66,7 +81,8 @@ func (finder *TraceFinder) traceIDsMultiSearchRequestBody(traceIDs []model.Trace
 	return multiSearchBody
 }
 
-func (finder *TraceFinder) getTracesToChannel(traceIDs []model.TraceID, tracesChan chan *model.Trace, startTime time.Time, endTime time.Time) error {
+// getTraces fetches the spans of the traces, traces without any span are not returned
+func (finder *TraceFinder) getTraces(ctx context.Context, traceIDs []model.TraceID, startTime time.Time, endTime time.Time) (map[model.TraceID]*model.Trace, error) {
 	nextTime := model.TimeAsEpochMicroseconds(startTime)
 	searchAfterTime := make(map[model.TraceID]uint64)
 	totalDocumentsFetched := make(map[model.TraceID]int)
@@ -79,23 +95,21 @@ func (finder *TraceFinder) getTracesToChannel(traceIDs []model.TraceID, tracesCh
 		// set traceIDs to empty
 		traceIDs = nil
 
-		results, err := finder.reader.getMultiSearchResult(multiSearchBody)
+		results, err := finder.reader.getMultiSearchResult(ctx, multiSearchBody)
 		if err != nil || results.Responses == nil || len(results.Responses) == 0 {
 			if err != nil {
-				return err
+				return nil, err
 			}
 			break
 		}
 
 		for _, result := range results.Responses {
 			if result.Hits == nil || len(result.Hits.Hits) == 0 {
-				tracesChan <- nil
 				continue
 			}
-			spans, err := finder.collectSpans(result.Hits.Hits)
+			spans, err := finder.collectSpans(ctx, result.Hits.Hits)
 			if err != nil {
 				finder.logger.Warn(fmt.Sprintf("can't collect spans form result: %s", err.Error()))
-				tracesChan <- nil
 				continue
 			}
 			lastSpan := spans[len(spans)-1]
@@ -114,17 +128,14 @@ func (finder *TraceFinder) getTracesToChannel(traceIDs []model.TraceID, tracesCh
 		}
 	}
 	finder.logger.Debug(fmt.Sprintf("%d traces return", len(tracesMap)))
-	if len(tracesMap) == 0 {
-		return errors.New(fmt.Sprintf("No search results for traces: %v", traceIDs))
-	}
-	for traceID := range tracesMap {
-		tracesChan <- tracesMap[traceID]
-	}
-	return nil
+	return tracesMap, nil
 }
 
-func (finder *TraceFinder) collectSpans(esSpansRaw []*elastic.SearchHit) ([]*model.Span, error) {
-	spans := make([]*model.Span, len(esSpansRaw))
+func (finder *TraceFinder) collectSpans(ctx context.Context, esSpansRaw []*elastic.SearchHit) (spans []*model.Span, err error) {
+	convertSpan, _ := startSpan(ctx, "convertSpans")
+	convertSpan.SetTag("spans", len(esSpansRaw))
+	defer func() { finishSpan(convertSpan, err) }()
+	spans = make([]*model.Span, len(esSpansRaw))
 
 	for i, esSpanRaw := range esSpansRaw {
 		jsonSpan, err := unmarshalJSONSpan(esSpanRaw)
@@ -141,63 +152,146 @@ func (finder *TraceFinder) collectSpans(esSpansRaw []*elastic.SearchHit) ([]*mod
 	return spans, nil
 }
 
-func (finder *TraceFinder) bulkSearchWithRetry(traceIDs []model.TraceID, tracesChan chan *model.Trace, startTime, endTime time.Time, bulkIndex int) {
-	err := retry.Do( // retry in case one of the bulk requests failed
-		func() error {
-			finder.logger.Debug(fmt.Sprintf("processing bulk %v", bulkIndex))
-			return finder.getTracesToChannel(traceIDs, tracesChan, startTime, endTime)
-		},
-		retry.Attempts(maxRetryAttempts),
-		retry.Delay(time.Millisecond*500),
-		retry.OnRetry(
-			func(n uint, err error) {
-				finder.logger.Debug(fmt.Sprintf("retrying bulk %d retry %d/%d", bulkIndex, n+1, maxRetryAttempts))
-			}),
-	)
-	if err != nil {
-		finder.logger.Error(fmt.Sprintf("failed to fetch bulk %d with %d traces: %s", bulkIndex, len(traceIDs), err.Error()))
+// traceIDsBulk is the trace ids fetched by a single multiSearch request
+type traceIDsBulk struct {
+	index    int
+	traceIDs []model.TraceID
+}
+
+// bulkResult holds the traces of a bulk, or the error which failed the bulk after all retries
+type bulkResult struct {
+	bulk   traceIDsBulk
+	traces map[model.TraceID]*model.Trace
+	err    error
+}
+
+// bulkSearch fetches the traces of a bulk, failed search requests are retried by the reader
+func (finder *TraceFinder) bulkSearch(ctx context.Context, bulk traceIDsBulk, startTime, endTime time.Time) bulkResult {
+	finder.logger.Debug(fmt.Sprintf("processing bulk %v", bulk.index))
+	traceBulksTotal.Inc()
+	span, spanCtx := startSpan(ctx, "bulkSearch")
+	span.SetTag("bulk", bulk.index)
+	span.SetTag("traces", len(bulk.traceIDs))
+	result := bulkResult{bulk: bulk}
+	result.traces, result.err = finder.getTraces(spanCtx, bulk.traceIDs, startTime, endTime)
+	finishSpan(span, result.err)
+	if ctx.Err() != nil {
+		result.err = ErrQueryDeadlineExceeded
+		finder.logger.Debug(fmt.Sprintf("bulk %d canceled: %s", bulk.index, ctx.Err().Error()))
+	} else if result.err != nil {
+		finder.logger.Error(fmt.Sprintf("failed to fetch bulk %d with %d traces: %s", bulk.index, len(bulk.traceIDs), result.err.Error()))
 	}
+	return result
+}
+
+// multiReadResult holds the fetched traces and the reason each of the missing traces was not retrieved
+type multiReadResult struct {
+	traces  []*model.Trace
+	missing map[model.TraceID]error
+}
+
+func newMultiReadResult() *multiReadResult {
+	return &multiReadResult{missing: make(map[model.TraceID]error)}
 }
 
-func (finder *TraceFinder) multiRead(traceIDs []model.TraceID, startTime, endTime time.Time) ([]*model.Trace, error) {
+// isPartial returns true if some of the requested traces were not retrieved
+func (result *multiReadResult) isPartial() bool {
+	return len(result.missing) > 0
+}
+
+func (result *multiReadResult) addBulk(bulk bulkResult) {
+	for _, traceID := range bulk.bulk.traceIDs {
+		if bulk.err != nil {
+			result.missing[traceID] = bulk.err
+		} else if trace, ok := bulk.traces[traceID]; ok {
+			result.traces = append(result.traces, trace)
+		} else {
+			result.missing[traceID] = spanstore.ErrTraceNotFound
+		}
+	}
+}
+
+func (result *multiReadResult) logMissing(logger hclog.Logger) {
+	for traceID, reason := range result.missing {
+		logger.Warn(fmt.Sprintf("trace %s was not retrieved: %s", traceID.String(), reason.Error()))
+	}
+}
+
+// multiRead fetches the traces in bulks with a bounded pool of workers.
+// When the query deadline passes, the traces retrieved so far are returned and the rest are reported as missing.
+// An error is returned only if the caller's context is done
+func (finder *TraceFinder) multiRead(ctx context.Context, traceIDs []model.TraceID, startTime, endTime time.Time) (*multiReadResult, error) {
+	result := newMultiReadResult()
 	if len(traceIDs) == 0 {
-		return []*model.Trace{}, nil
+		return result, nil
 	}
-	tracesChan := make(chan *model.Trace)
+	tracesRequestedTotal.Add(float64(len(traceIDs)))
+	queryCtx, cancel := context.WithTimeout(ctx, finder.queryTimeout)
+	defer cancel()
+
 	requestBulksCount := int(math.Ceil(float64(len(traceIDs)) / float64(maxBulkSize)))
-	finder.logger.Debug(fmt.Sprintf("performing %v bulk searches for %v traceIDs", requestBulksCount, len(traceIDs)))
-	expectedTraceCount := len(traceIDs)
-	for i := 0; i < requestBulksCount; i++ {
-		bulkStartOffset := i * maxBulkSize
-		bulkEnd := int(math.Min(float64(bulkStartOffset+maxBulkSize), float64(len(traceIDs))))
-		go finder.bulkSearchWithRetry(traceIDs[bulkStartOffset:bulkEnd], tracesChan, startTime, endTime, i+1)
-		time.Sleep(time.Millisecond * 300)
-	}
+	workersCount := int(math.Min(float64(finder.fetchConcurrency), float64(requestBulksCount)))
+	finder.logger.Debug(fmt.Sprintf("performing %v bulk searches for %v traceIDs with %d workers", requestBulksCount, len(traceIDs), workersCount))
 
-	var traces []*model.Trace
-	timeout := false
-	for i := 0; i < expectedTraceCount && !timeout; i++ {
-		select {
-		case trace := <-tracesChan:
-			if trace != nil {
-				traces = append(traces, trace)
-			} else {
-				finder.logger.Warn("missing a trace...")
+	bulks := make(chan traceIDsBulk)
+	results := make(chan bulkResult)
+	var workers sync.WaitGroup
+	for i := 0; i < workersCount; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for bulk := range bulks {
+				select {
+				case results <- finder.bulkSearch(queryCtx, bulk, startTime, endTime):
+				case <-queryCtx.Done():
+					return
+				}
 			}
-		case <-time.After(15 * time.Second): // continue if there are no traces in the channel for 15 seconds
-			{
-				finder.logger.Warn("got timeout while waiting for response")
-				timeout = true
+		}()
+	}
+	go func() {
+		defer close(bulks)
+		for i := 0; i < requestBulksCount; i++ {
+			bulkStartOffset := i * maxBulkSize
+			bulkEnd := int(math.Min(float64(bulkStartOffset+maxBulkSize), float64(len(traceIDs))))
+			select {
+			case bulks <- traceIDsBulk{index: i + 1, traceIDs: traceIDs[bulkStartOffset:bulkEnd]}:
+			case <-queryCtx.Done():
+				return
 			}
 		}
+	}()
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	fetchedTraceIDs := make(map[model.TraceID]bool)
+	for bulk := range results {
+		result.addBulk(bulk)
+		for _, traceID := range bulk.bulk.traceIDs {
+			fetchedTraceIDs[traceID] = true
+		}
 	}
-	return traces, nil
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for _, traceID := range traceIDs {
+		if !fetchedTraceIDs[traceID] {
+			result.missing[traceID] = ErrQueryDeadlineExceeded
+		}
+	}
+	tracesReturnedTotal.Add(float64(len(result.traces)))
+	return result, nil
 }
 
 func (finder *TraceFinder) findTraceIDsStrings(ctx context.Context, traceQuery *spanstore.TraceQueryParameters) ([]string, error) {
 	childSpan, _ := opentracing.StartSpanFromContext(ctx, "findTraceIDsStrings")
 	defer childSpan.Finish()
 
+	if finder.isTraceLevel(traceQuery) {
+		return finder.findTraceLevelTraceIDsStrings(ctx, traceQuery)
+	}
 	aggregation := buildTraceIDAggregation(traceQuery.NumTraces)
 	boolQuery := finder.buildFindTraceIDsQuery(traceQuery)
 
@@ -212,7 +306,7 @@ func (finder *TraceFinder) findTraceIDsStrings(ctx context.Context, traceQuery *
 		return nil, errors.Wrap(err, "can't create search request for trace query")
 	}
 	requestBody = fmt.Sprintf("{}\n%s\n", requestBody)
-	searchResult, err := finder.reader.getSearchResult(requestBody)
+	searchResult, err := finder.reader.getSearchResult(ctx, requestBody)
 	if err != nil {
 		return nil, errors.Wrap(err, "Search service failed")
 	}
@@ -226,20 +320,34 @@ func (finder *TraceFinder) findTraceIDsStrings(ctx context.Context, traceQuery *
 	return bucketToStringArray(traceIDBuckets)
 }
 
-func (finder *TraceFinder) buildTagQuery(k string, v string) elastic.Query {
+func (finder *TraceFinder) buildTagQuery(tag tagQuery) elastic.Query {
+	if tag.log {
+		return tag.negate(tag.logFieldsQuery(finder.logFieldsNested))
+	}
 	objectTagListLen := len(objectTagFieldList)
-	queries := make([]elastic.Query, objectTagListLen)
-	kd := finder.spanConverter.ReplaceDot(k)
+	queries := make([]elastic.Query, objectTagListLen, objectTagListLen+len(listTagFieldList))
+	kd := finder.spanConverter.ReplaceDot(tag.key)
 	for i := range objectTagFieldList {
-		queries[i] = buildObjectQuery(objectTagFieldList[i], kd, v)
+		queries[i] = tag.objectQuery(objectTagFieldList[i], kd)
+	}
+	// tags which aren't stored as fields by the tag layout are in the key value lists,
+	for _, field := range listTagFieldList {
+		if listQuery := tag.listQuery(field); listQuery != nil {
+			queries = append(queries, listQuery)
+		}
+	}
+	// and the tags are also looked up in the fields of the span logs
+	if logFieldsQuery := tag.logFieldsQuery(finder.logFieldsNested); logFieldsQuery != nil {
+		queries = append(queries, logFieldsQuery)
 	}
 
 	// but configuration can change over time
-	return elastic.NewBoolQuery().Should(queries...)
+	return tag.negate(elastic.NewBoolQuery().Should(queries...))
 }
 
 func (finder *TraceFinder) buildFindTraceIDsQuery(traceQuery *spanstore.TraceQueryParameters) elastic.Query {
-	boolQuery := elastic.NewBoolQuery()
+	boolQuery := elastic.NewBoolQuery().Filter(elastic.NewTermQuery(typeField, finder.reader.spanType)).
+		Filter(finder.reader.searchFields...)
 
 	//add duration query
 	if traceQuery.DurationMax != 0 || traceQuery.DurationMin != 0 {
@@ -264,8 +372,9 @@ func (finder *TraceFinder) buildFindTraceIDsQuery(traceQuery *spanstore.TraceQue
 	}
 
 	for k, v := range traceQuery.Tags {
-		tagQuery := finder.buildTagQuery(k, v)
-		boolQuery.Must(tagQuery)
+		// the tags are validated by validateQuery
+		tag, _ := parseTagQuery(k, v)
+		boolQuery.Must(finder.buildTagQuery(tag))
 	}
 	return boolQuery
 }
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/logzio/jaeger-logzio/store/objects"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiReadMissingTraces(tester *testing.T) {
+	foundTraceID := model.NewTraceID(0, 0x42)
+	missingTraceID := model.NewTraceID(0, 0x314)
+	spanBytes, _ := objects.TransformToLogzioSpanBytes(&model.Span{
+		TraceID:   foundTraceID,
+		SpanID:    model.NewSpanID(1),
+		StartTime: time.Now(),
+		Process:   model.NewProcess(testService, nil),
+	})
+	tracesServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(fmt.Sprintf("{\"responses\":[{\"hits\":{\"total\":1,\"hits\":[{\"_source\":%s}]}},{\"hits\":{\"total\":0,\"hits\":[]}}]}", spanBytes)))
+	}))
+	defer tracesServer.Close()
+	tracesReader := NewLogzioSpanReader(LogzioConfig{APIToken: testAPIToken, CustomAPIURL: tracesServer.URL}, logger)
+
+	result, err := tracesReader.traceFinder.multiRead(context.Background(), []model.TraceID{foundTraceID, missingTraceID}, time.Now().Add(-time.Hour), time.Now())
+	assert.NoError(tester, err)
+	assert.True(tester, result.isPartial())
+	assert.Equal(tester, 1, len(result.traces))
+	assert.Equal(tester, map[model.TraceID]error{missingTraceID: spanstore.ErrTraceNotFound}, result.missing)
+}
+
+func TestMultiReadQueryTimeout(tester *testing.T) {
+	release := make(chan struct{})
+	slowServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+	}))
+	defer slowServer.Close()
+	defer close(release)
+	slowReader := NewLogzioSpanReader(LogzioConfig{APIToken: testAPIToken, CustomAPIURL: slowServer.URL, QueryTimeout: 1, FetchConcurrency: 1}, logger)
+
+	traceIDs := make([]model.TraceID, maxBulkSize*3)
+	for i := range traceIDs {
+		traceIDs[i] = model.NewTraceID(0, uint64(i+1))
+	}
+	start := time.Now()
+	result, err := slowReader.traceFinder.multiRead(context.Background(), traceIDs, time.Now().Add(-time.Hour), time.Now())
+	assert.NoError(tester, err, "query timeout should return partial results rather than an error")
+	assert.True(tester, time.Since(start) < time.Second*5, "multiRead should return once the query timeout passed")
+	assert.Equal(tester, 0, len(result.traces))
+	assert.Equal(tester, len(traceIDs), len(result.missing))
+	for _, reason := range result.missing {
+		assert.Equal(tester, ErrQueryDeadlineExceeded, reason)
+	}
+}
@@ -0,0 +1,378 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+)
+
+const (
+	// traceCandidatesFactor is how many times the requested number of traces the first phase of a trace level search finds
+	traceCandidatesFactor = 5
+	// referenceSpanIDField is set on every span with a parent, so spans without it are root spans
+	referenceSpanIDField = "references.spanID"
+)
+
+// boundsSpan holds only the span fields needed to measure the duration of its trace
+type boundsSpan struct {
+	TraceID   string `json:"traceID"`
+	StartTime uint64 `json:"startTime"`
+	Duration  uint64 `json:"duration"`
+}
+
+// traceBounds are the start of the first span and the end of the last span of a trace, in microseconds
+type traceBounds struct {
+	start uint64
+	end   uint64
+}
+
+// isTraceLevel returns whether the query is matched by traces and not by single spans
+func (finder *TraceFinder) isTraceLevel(traceQuery *spanstore.TraceQueryParameters) bool {
+	return finder.traceLevelSearch || (hasDurationQuery(traceQuery) && finder.traceDuration != traceDurationSpan)
+}
+
+func hasDurationQuery(traceQuery *spanstore.TraceQueryParameters) bool {
+	return traceQuery.DurationMin != 0 || traceQuery.DurationMax != 0
+}
+
+// traceCriteria returns the queries a trace has to match. With trace level search every criterion may be matched by
+// a different span of the trace, otherwise all the criteria but the root span duration are matched by a single span.
+// The trace duration isn't a query, it's checked on the fetched traces
+func (finder *TraceFinder) traceCriteria(traceQuery *spanstore.TraceQueryParameters) []elastic.Query {
+	var criteria []elastic.Query
+	if !finder.traceLevelSearch {
+		spanQuery := *traceQuery
+		spanQuery.DurationMin, spanQuery.DurationMax = 0, 0
+		criteria = append(criteria, finder.buildFindTraceIDsQuery(&spanQuery))
+	} else {
+		// the operation belongs to the service, so they are matched by the same span
+		if traceQuery.ServiceName != "" || traceQuery.OperationName != "" {
+			serviceQuery := elastic.NewBoolQuery()
+			if traceQuery.ServiceName != "" {
+				serviceQuery.Must(buildServiceNameQuery(traceQuery.ServiceName))
+			}
+			if traceQuery.OperationName != "" {
+				serviceQuery.Must(buildOperationNameQuery(traceQuery.OperationName))
+			}
+			criteria = append(criteria, serviceQuery)
+		}
+		keys := make([]string, 0, len(traceQuery.Tags))
+		for key := range traceQuery.Tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			// the tags are validated by validateQuery
+			tag, _ := parseTagQuery(key, traceQuery.Tags[key])
+			criteria = append(criteria, finder.buildTagQuery(tag))
+		}
+	}
+	if hasDurationQuery(traceQuery) {
+		durationQuery := buildDurationQuery(traceQuery.DurationMin, traceQuery.DurationMax)
+		switch finder.traceDuration {
+		case traceDurationSpan:
+			criteria = append(criteria, durationQuery)
+		case traceDurationRoot:
+			criteria = append(criteria, elastic.NewBoolQuery().Must(durationQuery).
+				MustNot(elastic.NewNestedQuery(referencesField, elastic.NewExistsQuery(referenceSpanIDField))))
+		}
+	}
+	return criteria
+}
+
+// findTraceLevelTraceIDsStrings searches trace ids in two phases. The first phase finds candidate traces matching the
+// first criterion, the second phase keeps the candidates which match all the other criteria, by a search of each
+// criterion among the candidates. Traces are then checked for their total duration, if the query has one.
+// Until enough traces match, the candidates are paged back in time, each page ending at the oldest candidate of the
+// previous one, until the time range of the query is exhausted
+func (finder *TraceFinder) findTraceLevelTraceIDsStrings(ctx context.Context, traceQuery *spanstore.TraceQueryParameters) ([]string, error) {
+	criteria := finder.traceCriteria(traceQuery)
+	baseQuery := finder.buildFindTraceIDsQuery(&spanstore.TraceQueryParameters{StartTimeMin: traceQuery.StartTimeMin, StartTimeMax: traceQuery.StartTimeMax})
+	checkTraceDuration := hasDurationQuery(traceQuery) && finder.traceDuration == traceDurationTrace
+
+	candidatesCount := traceQuery.NumTraces
+	if len(criteria) > 1 || checkTraceDuration {
+		candidatesCount = traceQuery.NumTraces * traceCandidatesFactor
+		if candidatesCount > logzioMaxAggregationSize {
+			candidatesCount = logzioMaxAggregationSize
+		}
+	}
+	var firstCriterion elastic.Query
+	if len(criteria) > 0 {
+		firstCriterion, criteria = criteria[0], criteria[1:]
+	}
+	var traceIDs []string
+	seen := make(map[string]bool)
+	for pageEnd := traceQuery.StartTimeMax; len(traceIDs) < traceQuery.NumTraces; {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		firstQuery := finder.buildFindTraceIDsQuery(&spanstore.TraceQueryParameters{StartTimeMin: traceQuery.StartTimeMin, StartTimeMax: pageEnd})
+		if firstCriterion != nil {
+			firstQuery = elastic.NewBoolQuery().Filter(firstQuery).Must(firstCriterion)
+		}
+		page, oldestStartTime, err := finder.searchCandidateTraceIDs(ctx, firstQuery, candidatesCount)
+		if err != nil {
+			return nil, err
+		}
+		// traces on the page boundary are found again by the next page
+		var candidates []string
+		for _, traceID := range page {
+			if !seen[traceID] {
+				seen[traceID] = true
+				candidates = append(candidates, traceID)
+			}
+		}
+		matches, err := finder.matchCandidates(ctx, candidates, baseQuery, criteria, checkTraceDuration, traceQuery)
+		if err != nil {
+			return nil, err
+		}
+		traceIDs = append(traceIDs, matches...)
+
+		if len(page) < candidatesCount || oldestStartTime.IsZero() {
+			break
+		}
+		if !oldestStartTime.Before(pageEnd) {
+			// all the candidates of the page are as new as its end, step over it so we don't page forever
+			oldestStartTime = pageEnd.Add(-time.Microsecond)
+		}
+		if !oldestStartTime.After(traceQuery.StartTimeMin) {
+			break
+		}
+		pageEnd = oldestStartTime
+	}
+	if len(traceIDs) > traceQuery.NumTraces {
+		traceIDs = traceIDs[:traceQuery.NumTraces]
+	}
+	return traceIDs, nil
+}
+
+// matchCandidates returns the candidates which match all the criteria and the duration of the query, keeping their order
+func (finder *TraceFinder) matchCandidates(ctx context.Context, candidates []string, baseQuery elastic.Query, criteria []elastic.Query, checkTraceDuration bool, traceQuery *spanstore.TraceQueryParameters) ([]string, error) {
+	var err error
+	if len(criteria) > 0 && len(candidates) > 0 {
+		candidateIDs := make([]interface{}, len(candidates))
+		for i, candidate := range candidates {
+			candidateIDs[i] = candidate
+		}
+		candidatesQuery := elastic.NewTermsQuery(traceIDField, candidateIDs...)
+		queries := make([]elastic.Query, len(criteria))
+		for i, criterion := range criteria {
+			queries[i] = elastic.NewBoolQuery().Filter(baseQuery, candidatesQuery).Must(criterion)
+		}
+		var results [][]string
+		if results, err = finder.searchTraceIDs(ctx, queries, len(candidates)); err != nil {
+			return nil, err
+		}
+		for _, matches := range results {
+			candidates = intersectTraceIDs(candidates, matches)
+		}
+	}
+	if checkTraceDuration && len(candidates) > 0 {
+		if candidates, err = finder.filterTraceDuration(ctx, candidates, traceQuery); err != nil {
+			return nil, err
+		}
+	}
+	return candidates, nil
+}
+
+// searchCandidateTraceIDs returns the trace ids matching the query, newest first, and the start time of the last
+// matching span of the oldest one
+func (finder *TraceFinder) searchCandidateTraceIDs(ctx context.Context, query elastic.Query, size int) ([]string, time.Time, error) {
+	requestBody, err := elastic.NewSearchRequest().
+		Size(0).
+		Aggregation(traceIDAggregation, buildTraceIDAggregation(size)).
+		IgnoreUnavailable(true).
+		Query(query).
+		Body()
+	if err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "can't create search request for trace query")
+	}
+	searchResult, err := finder.reader.getSearchResult(ctx, fmt.Sprintf("{}\n%s\n", requestBody))
+	if err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "Search service failed")
+	}
+	if searchResult == nil || searchResult.Aggregations == nil {
+		return nil, time.Time{}, ErrUnableToFindTraceIDAggregation
+	}
+	bucket, found := searchResult.Aggregations.Terms(traceIDAggregation)
+	if !found {
+		return nil, time.Time{}, ErrUnableToFindTraceIDAggregation
+	}
+	traceIDs, err := bucketToStringArray(bucket.Buckets)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var oldestStartTime time.Time
+	if len(bucket.Buckets) > 0 {
+		startTime, found := bucket.Buckets[len(bucket.Buckets)-1].Max(startTimeField)
+		if found && startTime.Value != nil {
+			oldestStartTime = model.EpochMicrosecondsAsTime(uint64(*startTime.Value))
+		}
+	}
+	return traceIDs, oldestStartTime, nil
+}
+
+// searchTraceIDs returns the trace ids matching each of the queries, newest first, in a single multi search request
+func (finder *TraceFinder) searchTraceIDs(ctx context.Context, queries []elastic.Query, size int) ([][]string, error) {
+	multiSearchBody := ""
+	for _, query := range queries {
+		requestBody, err := elastic.NewSearchRequest().
+			Size(0).
+			Aggregation(traceIDAggregation, buildTraceIDAggregation(size)).
+			IgnoreUnavailable(true).
+			Query(query).
+			Body()
+		if err != nil {
+			return nil, errors.Wrap(err, "can't create search request for trace query")
+		}
+		multiSearchBody = fmt.Sprintf("%s{}\n%s\n", multiSearchBody, requestBody)
+	}
+	multiSearchResult, err := finder.reader.getMultiSearchResult(ctx, multiSearchBody)
+	if err != nil {
+		return nil, errors.Wrap(err, "Search service failed")
+	}
+	if len(multiSearchResult.Responses) != len(queries) {
+		return nil, ErrUnableToFindTraceIDAggregation
+	}
+	results := make([][]string, len(queries))
+	for i, searchResult := range multiSearchResult.Responses {
+		if searchResult == nil || searchResult.Aggregations == nil {
+			return nil, ErrUnableToFindTraceIDAggregation
+		}
+		bucket, found := searchResult.Aggregations.Terms(traceIDAggregation)
+		if !found {
+			return nil, ErrUnableToFindTraceIDAggregation
+		}
+		if results[i], err = bucketToStringArray(bucket.Buckets); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// intersectTraceIDs returns the trace ids which are also in matches, keeping their order
+func intersectTraceIDs(traceIDs []string, matches []string) []string {
+	matched := make(map[string]bool, len(matches))
+	for _, traceID := range matches {
+		matched[traceID] = true
+	}
+	var intersection []string
+	for _, traceID := range traceIDs {
+		if matched[traceID] {
+			intersection = append(intersection, traceID)
+		}
+	}
+	return intersection
+}
+
+// filterTraceDuration keeps the traces whose duration, from the start of their first span to the end of their last span,
+// is within the duration range of the query
+func (finder *TraceFinder) filterTraceDuration(ctx context.Context, traceIDs []string, traceQuery *spanstore.TraceQueryParameters) ([]string, error) {
+	bounds, err := finder.collectTraceBounds(ctx, traceIDs, traceQuery)
+	if err != nil {
+		return nil, err
+	}
+	minMicros := model.DurationAsMicroseconds(traceQuery.DurationMin)
+	maxMicros := model.DurationAsMicroseconds(traceQuery.DurationMax)
+	var filtered []string
+	for _, traceID := range traceIDs {
+		trace, ok := bounds[traceID]
+		if !ok {
+			continue
+		}
+		duration := trace.end - trace.start
+		if duration >= minMicros && (traceQuery.DurationMax == 0 || duration <= maxMicros) {
+			filtered = append(filtered, traceID)
+		}
+	}
+	return filtered, nil
+}
+
+func (finder *TraceFinder) traceBoundsRequestBody(traceIDs []string, fromTime, toTime uint64) (string, error) {
+	candidateIDs := make([]interface{}, len(traceIDs))
+	for i, traceID := range traceIDs {
+		candidateIDs[i] = traceID
+	}
+	query := elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery(typeField, finder.reader.spanType),
+		elastic.NewRangeQuery(startTimeField).Gte(fromTime).Lte(toTime),
+		elastic.NewTermsQuery(traceIDField, candidateIDs...)).
+		Filter(finder.reader.searchFields...)
+	source := elastic.NewSearchSource().
+		Query(query).
+		Size(defaultDocCount).
+		Sort(startTimeField, true).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).
+			Include(traceIDField, startTimeField, durationField))
+	requestBody, err := elastic.NewSearchRequest().
+		IgnoreUnavailable(true).
+		Source(source).
+		Body()
+	if err != nil {
+		return "", errors.Wrap(err, "can't create search request for trace duration")
+	}
+	return fmt.Sprintf("{}\n%s\n", requestBody), nil
+}
+
+// collectTraceBounds pages through the spans of the traces in the time range of the query, ordered by start time, and
+// computes the bounds of each trace from the start time and duration of its spans. Like the dependency spans, each page
+// starts at the start time of the last span of the previous one; spans fetched twice don't change the bounds
+func (finder *TraceFinder) collectTraceBounds(ctx context.Context, traceIDs []string, traceQuery *spanstore.TraceQueryParameters) (map[string]*traceBounds, error) {
+	bounds := make(map[string]*traceBounds, len(traceIDs))
+	fromTime := model.TimeAsEpochMicroseconds(traceQuery.StartTimeMin)
+	toTime := model.TimeAsEpochMicroseconds(traceQuery.StartTimeMax)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		requestBody, err := finder.traceBoundsRequestBody(traceIDs, fromTime, toTime)
+		if err != nil {
+			return nil, err
+		}
+		result, err := finder.reader.getSearchResult(ctx, requestBody)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to search spans for trace duration")
+		}
+		if result == nil || result.Hits == nil || len(result.Hits.Hits) == 0 {
+			break
+		}
+		lastStartTime := fromTime
+		for _, hit := range result.Hits.Hits {
+			var span boundsSpan
+			if hit.Source == nil || json.Unmarshal(*hit.Source, &span) != nil {
+				finder.logger.Warn("can't parse span for trace duration, skipping")
+				continue
+			}
+			spanEnd := span.StartTime + span.Duration
+			if trace, ok := bounds[span.TraceID]; !ok {
+				bounds[span.TraceID] = &traceBounds{start: span.StartTime, end: spanEnd}
+			} else {
+				if span.StartTime < trace.start {
+					trace.start = span.StartTime
+				}
+				if spanEnd > trace.end {
+					trace.end = spanEnd
+				}
+			}
+			lastStartTime = span.StartTime
+		}
+		if len(result.Hits.Hits) < defaultDocCount {
+			break
+		}
+		if lastStartTime <= fromTime {
+			// the whole page shares the same start time, step over it so we don't page forever
+			finder.logger.Warn(fmt.Sprintf("more than %d spans start at %d, some trace durations may be shorter", defaultDocCount, fromTime))
+			lastStartTime = fromTime + 1
+		}
+		fromTime = lastStartTime
+	}
+	return bounds, nil
+}
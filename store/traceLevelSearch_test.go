@@ -0,0 +1,146 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func traceIDsResponse(traceIDs ...string) string {
+	buckets := make([]string, len(traceIDs))
+	for i, traceID := range traceIDs {
+		buckets[i] = fmt.Sprintf(`{"key":"%s","doc_count":1,"startTime":{"value":%d}}`, traceID, len(traceIDs)-i)
+	}
+	return fmt.Sprintf(`{"hits":{"total":0,"hits":[]},"aggregations":{"traceIDs":{"buckets":[%s]}}}`, strings.Join(buckets, ","))
+}
+
+func TestTraceLevelSearch(tester *testing.T) {
+	var searchRequests []string
+	traceServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		searchRequests = append(searchRequests, string(body))
+		if strings.Contains(string(body), `"terms":{"traceID"`) {
+			_, _ = rw.Write([]byte(fmt.Sprintf(`{"responses":[%s,%s]}`, traceIDsResponse("314", "42", "7"), traceIDsResponse("42", "314"))))
+			return
+		}
+		_, _ = rw.Write([]byte(fmt.Sprintf(`{"responses":[%s]}`, traceIDsResponse("42", "99", "314", "7"))))
+	}))
+	defer traceServer.Close()
+	traceReader := NewLogzioSpanReader(LogzioConfig{APIToken: testAPIToken, CustomAPIURL: traceServer.URL, TraceLevelSearch: true}, logger)
+
+	traceIDs, err := traceReader.FindTraceIDs(context.Background(), &spanstore.TraceQueryParameters{
+		ServiceName:   testService,
+		OperationName: testOperation,
+		Tags:          map[string]string{"error": "true", "http.status_code>": "500"},
+		StartTimeMin:  time.Now().Add(-time.Hour),
+		StartTimeMax:  time.Now(),
+		NumTraces:     10,
+	})
+	assert.NoError(tester, err)
+	assert.Equal(tester, []model.TraceID{model.NewTraceID(0, 0x42), model.NewTraceID(0, 0x314)}, traceIDs)
+	assert.Len(tester, searchRequests, 2, "the criteria should be searched among the candidates in a single request")
+	assert.Contains(tester, searchRequests[0], `"size":50`)
+	assert.Contains(tester, searchRequests[0], serviceNameField)
+	assert.NotContains(tester, searchRequests[0], "JaegerTag")
+	assert.Contains(tester, searchRequests[1], `"terms":{"traceID":["42","99","314","7"]}`)
+	assert.Equal(tester, 2, strings.Count(searchRequests[1], "{}\n"))
+	assert.NotContains(tester, searchRequests[1], serviceNameField)
+}
+
+func TestTraceLevelSearchPagesCandidates(tester *testing.T) {
+	oldestStartTime := model.TimeAsEpochMicroseconds(time.Now().Add(-10 * time.Minute))
+	candidatesResponse := func(traceIDs ...string) string {
+		buckets := make([]string, len(traceIDs))
+		for i, traceID := range traceIDs {
+			buckets[i] = fmt.Sprintf(`{"key":"%s","doc_count":1,"startTime":{"value":%d}}`, traceID, oldestStartTime+uint64(len(traceIDs)-1-i))
+		}
+		return fmt.Sprintf(`{"hits":{"total":0,"hits":[]},"aggregations":{"traceIDs":{"buckets":[%s]}}}`, strings.Join(buckets, ","))
+	}
+	var candidateRequests, matchRequests []string
+	traceServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if strings.Contains(string(body), `"terms":{"traceID"`) {
+			matchRequests = append(matchRequests, string(body))
+			_, _ = rw.Write([]byte(fmt.Sprintf(`{"responses":[%s]}`, traceIDsResponse("6"))))
+			return
+		}
+		candidateRequests = append(candidateRequests, string(body))
+		if len(candidateRequests) == 1 {
+			_, _ = rw.Write([]byte(fmt.Sprintf(`{"responses":[%s]}`, candidatesResponse("5", "4", "3", "2", "1"))))
+			return
+		}
+		_, _ = rw.Write([]byte(fmt.Sprintf(`{"responses":[%s]}`, candidatesResponse("1", "6"))))
+	}))
+	defer traceServer.Close()
+	traceReader := NewLogzioSpanReader(LogzioConfig{APIToken: testAPIToken, CustomAPIURL: traceServer.URL, TraceLevelSearch: true}, logger)
+
+	traceIDs, err := traceReader.FindTraceIDs(context.Background(), &spanstore.TraceQueryParameters{
+		ServiceName:  testService,
+		Tags:         map[string]string{"error": "true"},
+		StartTimeMin: time.Now().Add(-time.Hour),
+		StartTimeMax: time.Now(),
+		NumTraces:    1,
+	})
+	assert.NoError(tester, err)
+	assert.Equal(tester, []model.TraceID{model.NewTraceID(0, 6)}, traceIDs, "the candidates should be paged until enough traces match")
+	assert.Len(tester, candidateRequests, 2, "the search should stop at a page smaller than the number of candidates")
+	assert.Contains(tester, candidateRequests[1], fmt.Sprintf(`"to":%d`, oldestStartTime))
+	assert.Len(tester, matchRequests, 2)
+	assert.Contains(tester, matchRequests[1], `"terms":{"traceID":["6"]}`, "the candidates of the previous page shouldn't be searched again")
+}
+
+func TestTraceCriteria(tester *testing.T) {
+	query := &spanstore.TraceQueryParameters{ServiceName: testService, Tags: map[string]string{"error": "true"}, DurationMin: time.Second}
+	finder := NewTraceFinder(reader, LogzioConfig{})
+	assert.False(tester, finder.isTraceLevel(query))
+
+	finder = NewTraceFinder(reader, LogzioConfig{TraceDuration: traceDurationRoot})
+	assert.True(tester, finder.isTraceLevel(query))
+	criteria := finder.traceCriteria(query)
+	assert.Len(tester, criteria, 2, "the span criteria should be matched by a single span")
+	assert.NotContains(tester, tagQuerySource(tester, criteria[0]), durationField)
+	assert.Contains(tester, tagQuerySource(tester, criteria[1]), `"must_not":{"nested":{"path":"references","query":{"exists":{"field":"references.spanID"}}}}`)
+
+	finder = NewTraceFinder(reader, LogzioConfig{TraceLevelSearch: true, TraceDuration: traceDurationTrace})
+	assert.Len(tester, finder.traceCriteria(query), 2, "the trace duration should be checked on the fetched traces")
+}
+
+func TestTraceLevelSearchTraceDuration(tester *testing.T) {
+	var boundsRequests []string
+	traceServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if !strings.Contains(string(body), `"_source"`) {
+			_, _ = rw.Write([]byte(fmt.Sprintf(`{"responses":[%s]}`, traceIDsResponse("2", "1"))))
+			return
+		}
+		boundsRequests = append(boundsRequests, string(body))
+		_, _ = rw.Write([]byte(`{"responses":[{"hits":{"total":3,"hits":[` +
+			`{"_source":{"traceID":"1","startTime":1000000,"duration":1000000}},` +
+			`{"_source":{"traceID":"2","startTime":1000000,"duration":1000000}},` +
+			`{"_source":{"traceID":"1","startTime":3000000,"duration":1000000}}]}}]}`))
+	}))
+	defer traceServer.Close()
+	traceReader := NewLogzioSpanReader(LogzioConfig{APIToken: testAPIToken, CustomAPIURL: traceServer.URL, TraceDuration: traceDurationTrace}, logger)
+
+	traceIDs, err := traceReader.FindTraceIDs(context.Background(), &spanstore.TraceQueryParameters{
+		ServiceName:  testService,
+		DurationMin:  2 * time.Second,
+		StartTimeMin: time.Now().Add(-time.Hour),
+		StartTimeMax: time.Now(),
+	})
+	assert.NoError(tester, err)
+	assert.Equal(tester, []model.TraceID{model.NewTraceID(0, 1)}, traceIDs, "only the trace whose spans span 3 seconds is long enough")
+	assert.Len(tester, boundsRequests, 1, "the traces should be measured by a single page of their spans")
+	assert.Contains(tester, boundsRequests[0], `"terms":{"traceID":["2","1"]}`)
+	assert.Contains(tester, boundsRequests[0], `"includes":["traceID","startTime","duration"]`)
+	assert.NotContains(tester, boundsRequests[0], "script")
+}
@@ -4,7 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jaegertracing/jaeger/pkg/cache"
@@ -14,6 +17,7 @@ import (
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/jaegertracing/jaeger/model"
+	"github.com/shirou/gopsutil/v3/disk"
 )
 
 const (
@@ -35,36 +39,161 @@ func (writer *loggerWriter) Write(msgBytes []byte) (n int, err error) {
 	return len(msgBytes), nil
 }
 
+// logzioSender wraps the logzio sender to count the documents it drops and to measure its disk queue
+type logzioSender struct {
+	*logzio.LogzioSender
+	inMemoryQueue bool
+	// queueDir is the directory of the sender's disk queue
+	queueDir string
+}
+
+// Send queues the payload. The sender drops payloads without an error when the disk of its queue is full,
+// so the disk is checked here first and the payloads it would drop are counted and dropped
+func (sender *logzioSender) Send(payload []byte) error {
+	if !sender.inMemoryQueue {
+		if usage, err := queueDiskUsage(sender.queueDir); err == nil && usage > dropLogsDiskThreshold {
+			senderDroppedTotal.Inc()
+			return nil
+		}
+	}
+	return sender.LogzioSender.Send(payload)
+}
+
+// Stop drains the sender and stops measuring its queue
+func (sender *logzioSender) Stop() {
+	sender.LogzioSender.Stop()
+	if !sender.inMemoryQueue {
+		senderQueueDirs.remove(sender.queueDir)
+	}
+}
+
+// queueDiskUsage returns the used percent of the disk of the queue directory
+func queueDiskUsage(queueDir string) (float64, error) {
+	usage, err := disk.Usage(queueDir)
+	if err != nil {
+		// the queue directory is created lazily, check the disk of its parent directory
+		usage, err = disk.Usage(filepath.Dir(filepath.Dir(queueDir)))
+	}
+	if err != nil {
+		return 0, err
+	}
+	return usage.UsedPercent, nil
+}
+
+// queueDirs holds the disk queue directories of the open senders, the archive writer may share the span writer's
+type queueDirs struct {
+	lock sync.Mutex
+	dirs map[string]int
+}
+
+var senderQueueDirs = &queueDirs{dirs: make(map[string]int)}
+
+func (queues *queueDirs) add(dir string) {
+	queues.lock.Lock()
+	defer queues.lock.Unlock()
+	queues.dirs[dir]++
+}
+
+func (queues *queueDirs) remove(dir string) {
+	queues.lock.Lock()
+	defer queues.lock.Unlock()
+	if queues.dirs[dir]--; queues.dirs[dir] <= 0 {
+		delete(queues.dirs, dir)
+	}
+}
+
+// size returns the total size of the files in the queue directories
+func (queues *queueDirs) size() float64 {
+	queues.lock.Lock()
+	defer queues.lock.Unlock()
+	var size int64
+	for dir := range queues.dirs {
+		_ = filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				size += info.Size()
+			}
+			return nil
+		})
+	}
+	return float64(size)
+}
+
 // LogzioSpanWriter is a struct which holds logzio span writer properties
 type LogzioSpanWriter struct {
 	accountToken string
 	logger       hclog.Logger
-	sender       *logzio.LogzioSender
+	sender       *logzioSender
 	serviceCache cache.Cache
+	redactor     *redactor
+	filter       *spanFilter
+	spanLimits   SpanLimits
+	extraFields  *extraFields
+	tagLayout    objects.TagLayout
+	// dependencyAggregator is nil unless precomputed dependencies are enabled
+	dependencyAggregator *dependencyAggregator
+	// tailSampler is nil unless tail sampling is enabled
+	tailSampler *tailSampler
 }
 
-// NewLogzioSpanWriter creates a new logzio span writer for jaeger
-func NewLogzioSpanWriter(config LogzioConfig, logger hclog.Logger) (*LogzioSpanWriter, error) {
+// newLogzioSender creates a sender to the account of the token, the queue of a tenant sender is named after the tenant
+func newLogzioSender(config LogzioConfig, accountToken string, tenant string, logger hclog.Logger) (*logzioSender, error) {
+	debug := &loggerWriter{logger: logger}
+	queueDir := config.customQueueDir()
+	if tenant != "" {
+		queueDir = fmt.Sprintf("%s-%s", queueDir, tenant)
+	}
 	sender, err := logzio.New(
-		config.AccountToken,
+		accountToken,
 		logzio.SetUrl(config.ListenerURL()),
-		logzio.SetDebug(&loggerWriter{logger: logger}),
+		logzio.SetDebug(debug),
 		logzio.SetDrainDiskThreshold(dropLogsDiskThreshold),
-		logzio.SetTempDirectory(config.customQueueDir()),
+		logzio.SetTempDirectory(queueDir),
 		logzio.SetCompress(config.Compress),
 		logzio.SetInMemoryQueue(config.InMemoryQueue),
 		logzio.SetlogCountLimit(config.defaultLogCountLimit()),
 		logzio.SetinMemoryCapacity(config.defaultInMemoryCapacity()),
 		logzio.SetDrainDuration(config.drainIntervalToDuration()),
 	)
+	if err != nil {
+		return nil, err
+	}
+	if !config.InMemoryQueue {
+		senderQueueDirs.add(queueDir)
+	}
+	return &logzioSender{LogzioSender: sender, inMemoryQueue: config.InMemoryQueue, queueDir: queueDir}, nil
+}
 
+// NewLogzioSpanWriter creates a new logzio span writer for jaeger
+func NewLogzioSpanWriter(config LogzioConfig, logger hclog.Logger) (*LogzioSpanWriter, error) {
+	return newLogzioSpanWriter(config, config.AccountToken, "", logger)
+}
+
+func newLogzioSpanWriter(config LogzioConfig, accountToken string, tenant string, logger hclog.Logger) (*LogzioSpanWriter, error) {
+	redactor, err := newRedactor(config.RedactionRules)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := newSpanFilter(config.FilterRules)
+	if err != nil {
+		return nil, err
+	}
+	extraFields, err := newExtraFields(config.ExtraFields)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := newLogzioSender(config, accountToken, tenant, logger)
 	if err != nil {
 		return nil, err
 	}
 	spanWriter := &LogzioSpanWriter{
-		accountToken: config.AccountToken,
+		accountToken: accountToken,
 		logger:       logger,
 		sender:       sender,
+		redactor:     redactor,
+		filter:       filter,
+		spanLimits:   config.SpanLimits,
+		extraFields:  extraFields,
+		tagLayout:    config.tagLayout(),
 		serviceCache: cache.NewLRUWithOptions(
 			100000,
 			&cache.Options{
@@ -72,21 +201,49 @@ func NewLogzioSpanWriter(config LogzioConfig, logger hclog.Logger) (*LogzioSpanW
 			},
 		),
 	}
+	if config.WriteDependencies {
+		spanWriter.dependencyAggregator = newDependencyAggregator(config.dependenciesIntervalToDuration(), spanWriter.sendDocument, logger)
+		spanWriter.dependencyAggregator.start()
+	}
+	if config.TailSampling.Enabled {
+		spanWriter.tailSampler, err = newTailSampler(config.TailSampling, config.tailSamplingDecisionWait(), config.tailSamplingMaxTraces(), config.tailSamplingMaxBytes(), spanWriter.sendSpan, logger)
+		if err != nil {
+			spanWriter.Close()
+			return nil, err
+		}
+		spanWriter.tailSampler.start()
+	}
 	return spanWriter, nil
 }
 
 // WriteSpan receives a Jaeger span, converts it to logzio span and sends it to logzio
 func (spanWriter *LogzioSpanWriter) WriteSpan(ctx context.Context, span *model.Span) error {
+	err := spanWriter.writeSpan(span)
+	if err != nil {
+		writeErrorsTotal.Inc()
+	}
+	return err
+}
+
+func (spanWriter *LogzioSpanWriter) writeSpan(span *model.Span) error {
+	if !spanWriter.filter.keep(span) {
+		return nil
+	}
 	span.Tags = spanWriter.dropEmptyTags(span.Tags)
 	span.Process.Tags = spanWriter.dropEmptyTags(span.Process.Tags)
-	spanBytes, err := objects.TransformToLogzioSpanBytes(span)
+	spanWriter.redactor.redactSpan(span)
+	spanBytes, err := spanWriter.spanLimits.transformSpan(span, spanWriter.transformSpan)
 	if err != nil {
 		return err
 	}
-	err = spanWriter.sender.Send(spanBytes)
-	if err != nil {
+	if spanWriter.tailSampler != nil {
+		spanWriter.tailSampler.add(span, spanBytes)
+	} else if err = spanWriter.sendSpan(spanBytes); err != nil {
 		return err
 	}
+	if spanWriter.dependencyAggregator != nil {
+		spanWriter.dependencyAggregator.add(span)
+	}
 	service := objects.NewLogzioService(span)
 	serviceHash, err := service.HashCode()
 
@@ -98,13 +255,44 @@ func (spanWriter *LogzioSpanWriter) WriteSpan(ctx context.Context, span *model.S
 		if err != nil {
 			return err
 		}
-		err = spanWriter.sender.Send(serviceBytes)
+		if err = spanWriter.sendDocument(serviceBytes); err == nil {
+			servicesWrittenTotal.Inc()
+		}
 	}
 	return err
 }
 
+// transformSpan converts the span to a logzio span document with the extra fields
+func (spanWriter *LogzioSpanWriter) transformSpan(span *model.Span) ([]byte, error) {
+	spanBytes, err := spanWriter.tagLayout.TransformToLogzioSpanBytes(span)
+	if err != nil {
+		return nil, err
+	}
+	return spanWriter.extraFields.stamp(spanBytes), nil
+}
+
+// sendDocument sends a service or dependency document with the extra fields
+func (spanWriter *LogzioSpanWriter) sendDocument(document []byte) error {
+	return spanWriter.sender.Send(spanWriter.extraFields.stamp(document))
+}
+
+func (spanWriter *LogzioSpanWriter) sendSpan(spanBytes []byte) error {
+	if err := spanWriter.sender.Send(spanBytes); err != nil {
+		return err
+	}
+	spansWrittenTotal.WithLabelValues(spanDocumentType).Inc()
+	return nil
+}
+
 // Close stops and drains logzio sender
 func (spanWriter *LogzioSpanWriter) Close() {
+	if spanWriter.dependencyAggregator != nil {
+		spanWriter.dependencyAggregator.close()
+	}
+	if spanWriter.tailSampler != nil {
+		spanWriter.tailSampler.close()
+	}
+	spanWriter.filter.logDropped(spanWriter.logger)
 	spanWriter.sender.Stop()
 }
 
@@ -195,3 +195,68 @@ func TestDropEmptyTagsInMemory(tester *testing.T) {
 	assert.Equal(tester, 1, len(logzioSpan.Process.Tag))
 
 }
+
+func TestWriteDependencies(tester *testing.T) {
+	var sentDocuments [][]byte
+	aggregator := newDependencyAggregator(time.Minute, func(document []byte) error {
+		sentDocuments = append(sentDocuments, document)
+		return nil
+	}, logger)
+	parent := &model.Span{
+		TraceID: model.NewTraceID(0, 1),
+		SpanID:  model.NewSpanID(1),
+		Process: model.NewProcess("frontend", nil),
+	}
+	child := &model.Span{
+		TraceID:    model.NewTraceID(0, 1),
+		SpanID:     model.NewSpanID(2),
+		References: []model.SpanRef{model.NewChildOfRef(parent.TraceID, parent.SpanID)},
+		Tags:       []model.KeyValue{model.Bool("error", true)},
+		Process:    model.NewProcess(testService, nil),
+	}
+	// the child arrives first, it is resolved when the interval is flushed
+	aggregator.add(child)
+	aggregator.add(parent)
+	aggregator.flush()
+
+	assert.Equal(tester, 1, len(sentDocuments))
+	var dependency objects.LogzioDependency
+	assert.NoError(tester, json.Unmarshal(sentDocuments[0], &dependency))
+	assert.Equal(tester, "frontend", dependency.ParentService)
+	assert.Equal(tester, testService, dependency.ChildService)
+	assert.Equal(tester, uint64(1), dependency.CallCount)
+	assert.Equal(tester, uint64(1), dependency.ErrorCount)
+	assert.Equal(tester, "jaegerDependency", dependency.Type)
+
+	aggregator.flush()
+	assert.Equal(tester, 1, len(sentDocuments), "counts should be reset after a flush")
+}
+
+func TestWriteArchiveSpan(tester *testing.T) {
+	var recordedRequests []byte
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		recordedRequests, _ = ioutil.ReadAll(req.Body)
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	defer server.Close()
+	span := &model.Span{
+		TraceID:       model.NewTraceID(0, 1),
+		SpanID:        model.NewSpanID(0),
+		OperationName: testOperation,
+		Process: &model.Process{
+			ServiceName: testService,
+		},
+	}
+
+	writer, _ := NewLogzioArchiveSpanWriter(LogzioConfig{AccountToken: testAccountToken, CustomListenerURL: server.URL, Compress: false}, logger)
+	assert.NoError(tester, writer.WriteSpan(context.Background(), span))
+
+	time.Sleep(time.Second * 6)
+	requests := strings.Split(string(recordedRequests), "\n")
+	var logzioSpan objects.LogzioSpan
+	assert.NoError(tester, json.Unmarshal([]byte(requests[0]), &logzioSpan))
+	assert.Equal(tester, logzioSpan.OperationName, testOperation)
+	assert.Equal(tester, logzioSpan.Type, "jaegerArchiveSpan")
+	assert.Equal(tester, 2, len(requests), "archive writer should not send service documents")
+}